@@ -0,0 +1,230 @@
+package main
+
+import "crypto/rand"
+import "encoding/base64"
+import "errors"
+import "strconv"
+import "strings"
+import "gopkg.in/redis.v4"
+import "github.com/jinzhu/gorm"
+import "github.com/satori/go.uuid"
+import "golang.org/x/crypto/bcrypt"
+
+const MIN_PASSWORD_LENGTH = 8
+
+var ErrInvalidCredentials = errors.New("Invalid email or password")
+var ErrWalletOwned = errors.New("This wallet belongs to another account")
+
+// Compared against when the email is unknown, see Authenticate.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Account is a registered advertiser. Accounts own the session wallets
+// they were used from, so clearing cookies no longer loses funds or ads.
+type Account struct {
+	gorm.Model
+	Email        string `gorm:"not null;unique_index"`
+	PasswordHash string `gorm:"not null"`
+}
+
+// AccountWallet links a session, and therefore its wallet, to an account.
+type AccountWallet struct {
+	gorm.Model
+	AccountID uint   `gorm:"not null;index"`
+	SessionId string `gorm:"not null;unique_index"`
+}
+
+// AccountManager stores accounts in Postgres and login sessions in Redis.
+type AccountManager struct {
+	dbs    *gorm.DB
+	client *redis.Client
+	cost   int
+}
+
+func NewAccountManager(dbs *gorm.DB, client *redis.Client) (*AccountManager, error) {
+	if err := dbs.AutoMigrate(&Account{}, &AccountWallet{}).Error; err != nil {
+		return nil, err
+	}
+	return &AccountManager{
+		dbs:    dbs,
+		client: client,
+		cost:   bcrypt.DefaultCost,
+	}, nil
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Register creates an account. Emails are compared case insensitively.
+func (am *AccountManager) Register(email string, password string) (*Account, error) {
+	email = normalizeEmail(email)
+	if len(email) < 3 || len(email) > 254 || !strings.Contains(email, "@") {
+		return nil, errors.New("Invalid email address")
+	}
+	if len(password) < MIN_PASSWORD_LENGTH {
+		return nil, errors.New("Password must be at least " + strconv.Itoa(MIN_PASSWORD_LENGTH) + " characters")
+	}
+
+	existing := 0
+	if err := am.dbs.Model(&Account{}).Where("email = ?", email).Count(&existing).Error; err != nil {
+		return nil, err
+	}
+	if existing > 0 {
+		return nil, errors.New("An account already exists for this email")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), am.cost)
+	if err != nil {
+		return nil, err
+	}
+	account := &Account{
+		Email:        email,
+		PasswordHash: string(hash),
+	}
+	if err := am.dbs.Create(account).Error; err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Authenticate returns the account matching email and password. Unknown
+// emails still cost a bcrypt comparison so they cannot be told apart.
+func (am *AccountManager) Authenticate(email string, password string) (*Account, error) {
+	account := &Account{}
+	err := am.dbs.Where("email = ?", normalizeEmail(email)).First(account).Error
+	if err == gorm.ErrRecordNotFound {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return account, nil
+}
+
+func (am *AccountManager) Get(id uint) (*Account, error) {
+	account := &Account{}
+	if err := am.dbs.First(account, id).Error; err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// LinkWallet attaches the wallet of session to an account. A wallet belongs
+// to a single account, and its seed stops expiring once linked.
+func (am *AccountManager) LinkWallet(accountId uint, session uuid.UUID) error {
+	wallet := &AccountWallet{}
+	err := am.dbs.Where("session_id = ?", session.String()).First(wallet).Error
+	if err == nil {
+		if wallet.AccountID != accountId {
+			return ErrWalletOwned
+		}
+		return am.keepSeed(session)
+	} else if err != gorm.ErrRecordNotFound {
+		return err
+	}
+
+	err = am.dbs.Create(&AccountWallet{
+		AccountID: accountId,
+		SessionId: session.String(),
+	}).Error
+	if err != nil {
+		return err
+	}
+	return am.keepSeed(session)
+}
+
+// keepSeed stops the seed of a linked wallet from expiring with the
+// session, the account may come back for its funds at any time.
+func (am *AccountManager) keepSeed(session uuid.UUID) error {
+	if err := am.client.Set(keyForLinkedSeed(session), "1", 0).Err(); err != nil {
+		return err
+	}
+	return am.client.Persist(keyForSeed(session)).Err()
+}
+
+// WalletOwner returns the account a session wallet is linked to, 0 when
+// it is not linked.
+func (am *AccountManager) WalletOwner(session uuid.UUID) (uint, error) {
+	wallet := &AccountWallet{}
+	err := am.dbs.Where("session_id = ?", session.String()).First(wallet).Error
+	if err == gorm.ErrRecordNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return wallet.AccountID, nil
+}
+
+// Wallets lists the wallets of an account, most recently linked first.
+func (am *AccountManager) Wallets(accountId uint) ([]AccountWallet, error) {
+	var wallets []AccountWallet
+	err := am.dbs.Where("account_id = ?", accountId).Order("id desc").Find(&wallets).Error
+	return wallets, err
+}
+
+func (am *AccountManager) keyForLogin(token string) string {
+	return "account_session:" + token
+}
+
+type walletLinker interface {
+	LinkWallet(accountId uint, session uuid.UUID) error
+	Wallets(accountId uint) ([]AccountWallet, error)
+}
+
+// walletForLogin picks the wallet a session uses once logged in: the current
+// one, now linked to the account, unless another account owns it. Then it
+// is the latest wallet of the account, or a new one.
+func walletForLogin(wallets walletLinker, accountId uint, session uuid.UUID) (uuid.UUID, error) {
+	err := wallets.LinkWallet(accountId, session)
+	if err != ErrWalletOwned {
+		return session, err
+	}
+
+	owned, err := wallets.Wallets(accountId)
+	if err != nil {
+		return session, err
+	}
+	if len(owned) > 0 {
+		return uuid.FromString(owned[0].SessionId)
+	}
+	fresh := uuid.NewV4()
+	return fresh, wallets.LinkWallet(accountId, fresh)
+}
+
+// Login starts a login session for an account and returns its token.
+func (am *AccountManager) Login(accountId uint) (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(data)
+
+	err := am.client.Set(
+		am.keyForLogin(token), strconv.FormatUint(uint64(accountId), 10), SESSION_LIFE,
+	).Err()
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// AccountForLogin returns the account logged in with token.
+func (am *AccountManager) AccountForLogin(token string) (uint, error) {
+	val, err := am.client.Get(am.keyForLogin(token)).Result()
+	if err == redis.Nil {
+		return 0, errors.New("Not logged in")
+	} else if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.ParseUint(val, 10, 64)
+	return uint(id), err
+}
+
+func (am *AccountManager) Logout(token string) error {
+	return am.client.Del(am.keyForLogin(token)).Err()
+}
@@ -0,0 +1,100 @@
+package main
+
+import "testing"
+import "github.com/jinzhu/gorm"
+import "github.com/satori/go.uuid"
+
+func TestNormalizeEmail(t *testing.T) {
+	if email := normalizeEmail("  Alice@Example.COM "); email != "alice@example.com" {
+		t.Errorf("got %q", email)
+	}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	am := &AccountManager{}
+	if _, err := am.Register("not an email", "long enough password"); err == nil {
+		t.Error("invalid email accepted")
+	}
+	if _, err := am.Register("alice@example.com", "short"); err == nil {
+		t.Error("short password accepted")
+	}
+}
+
+type fakeWallets struct {
+	owners  map[uuid.UUID]uint
+	wallets map[uint][]AccountWallet
+}
+
+func (f *fakeWallets) LinkWallet(accountId uint, session uuid.UUID) error {
+	if owner, ok := f.owners[session]; ok && owner != accountId {
+		return ErrWalletOwned
+	}
+	f.owners[session] = accountId
+	return nil
+}
+
+func (f *fakeWallets) Wallets(accountId uint) ([]AccountWallet, error) {
+	return f.wallets[accountId], nil
+}
+
+func TestWalletForLogin(t *testing.T) {
+	walletA := uuid.NewV4()
+	walletB := uuid.NewV4()
+	wallets := &fakeWallets{
+		owners: map[uuid.UUID]uint{walletA: 1, walletB: 2},
+		wallets: map[uint][]AccountWallet{
+			2: {{AccountID: 2, SessionId: walletB.String()}},
+		},
+	}
+
+	// Logging in as B while holding A's wallet switches to B's own
+	session, err := walletForLogin(wallets, 2, walletA)
+	if err != nil || !uuid.Equal(session, walletB) {
+		t.Errorf("got %s, %v, want wallet of B", session, err)
+	}
+
+	// An account without wallets gets a new one
+	session, err = walletForLogin(wallets, 3, walletA)
+	if err != nil || uuid.Equal(session, walletA) || wallets.owners[session] != 3 {
+		t.Errorf("got %s, %v, want a new wallet of account 3", session, err)
+	}
+
+	// Anonymous wallets are kept and linked
+	anonymous := uuid.NewV4()
+	session, err = walletForLogin(wallets, 1, anonymous)
+	if err != nil || !uuid.Equal(session, anonymous) || wallets.owners[anonymous] != 1 {
+		t.Errorf("got %s, %v, want the anonymous wallet linked", session, err)
+	}
+}
+
+func TestLinkWalletKeepsSeed(t *testing.T) {
+	if err := client.Ping().Err(); err != nil {
+		t.Skip("redis is not available:", err)
+	}
+	dbs, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := NewAccountManager(dbs, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A wallet used before it was linked, and one linked before its seed
+	// was generated
+	used, fresh := uuid.NewV4(), uuid.NewV4()
+	newTestKeyManager(t, used).GetMasterKey()
+	if ttl, _ := client.TTL(keyForSeed(used)).Result(); ttl <= 0 {
+		t.Fatalf("anonymous seed has ttl %s", ttl)
+	}
+
+	for _, session := range []uuid.UUID{used, fresh} {
+		if err := accounts.LinkWallet(1, session); err != nil {
+			t.Fatal(err)
+		}
+		newTestKeyManager(t, session).GetMasterKey()
+		if ttl, _ := client.TTL(keyForSeed(session)).Result(); ttl >= 0 {
+			t.Errorf("linked seed expires in %s", ttl)
+		}
+	}
+}
@@ -4,28 +4,30 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"os"
 	"os/user"
 	"path/filepath"
 	"strconv"
 	"time"
 
-	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcrpcclient"
 	"github.com/btcsuite/btcutil"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"gopkg.in/redis.v4"
+
+	"milliondollar/pkg/network"
 )
 
 var (
 	client    *redis.Client
-	Info      *log.Logger
-	Error     *log.Logger
+	Log       = logrus.New()
 	RPCClient *btcrpcclient.Client
 	dbs       *gorm.DB
+	net       *chaincfg.Params
 )
 
 type Transaction struct {
@@ -39,8 +41,7 @@ type Transaction struct {
 }
 
 func init() {
-	Info = log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	Error = log.New(os.Stdout, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
+	Log.Formatter = &logrus.JSONFormatter{}
 
 	// add configuration directory
 	viper.SetConfigName("app")
@@ -48,12 +49,12 @@ func init() {
 	viper.AddConfigPath(filepath.Join(usr.HomeDir, ".mdp/"))
 	err := viper.ReadInConfig()
 	if err != nil {
-		Error.Fatal(err)
+		Log.Fatal(err)
 	}
 
 	dbs, err = gorm.Open("postgres", viper.GetString("db.pg"))
 	if err != nil {
-		Error.Fatal(err)
+		Log.Fatal(err)
 	}
 	dbs.AutoMigrate(&Transaction{})
 
@@ -66,7 +67,7 @@ func init() {
 	btcdHomeDir := btcutil.AppDataDir("btcd", false)
 	certs, err := ioutil.ReadFile(filepath.Join(btcdHomeDir, "rpc.cert"))
 	if err != nil {
-		Error.Fatal(err)
+		Log.Fatal(err)
 	}
 
 	connCfg := &btcrpcclient.ConnConfig{
@@ -78,175 +79,225 @@ func init() {
 	}
 	RPCClient, err = btcrpcclient.New(connCfg, nil)
 	if err != nil {
-		Error.Fatal(err)
+		Log.Fatal(err)
+	}
+
+	// Addresses are extracted from output scripts, so we need the network.
+	// db.btcd.is_simnet is still honoured when no network is set.
+	net, err = network.Params(network.Name(
+		viper.GetString("db.btcd.network"), viper.GetBool("db.btcd.is_simnet"),
+	))
+	if err != nil {
+		Log.Fatal(err)
+	}
+	if err := network.CheckNode(RPCClient, net); err != nil {
+		Log.Fatal(err)
 	}
+	Log.Infoln("Monitoring", net.Name)
 }
 
-func GetLastSyncedBlock() int64 {
+func GetLastSyncedBlock() (int64, error) {
 	res, err := client.Get("last_synced_block").Result()
 	if err == redis.Nil {
-		return 0
+		return 0, nil
 	} else if err != nil {
-		Error.Fatal(err)
+		return 0, err
 	}
+	return strconv.ParseInt(res, 10, 64)
+}
 
-	i, err := strconv.ParseInt(res, 10, 64)
-	if err != nil {
-		Error.Fatal(err)
+// OperateMempool marks the inputs spent by mempool transactions every few
+// seconds. Failures are logged and retried on the next pass.
+func OperateMempool() {
+	failCount := make(map[string]int)
+	for {
+		if err := SyncMempool(failCount); err != nil {
+			Log.Errorln("Unable to sync the mempool", err)
+		}
+		time.Sleep(time.Second * 5)
 	}
-	return i
 }
 
-func GetCurrentBlockCount() int64 {
-	count, err := RPCClient.GetBlockCount()
+// SyncMempool runs a single pass of OperateMempool. failCount tracks the
+// transactions that could not be fetched across passes.
+func SyncMempool(failCount map[string]int) error {
+	results, err := RPCClient.GetRawMempool()
 	if err != nil {
-		Error.Fatal(err)
+		return err
 	}
-	return count
+	mempoolSize.Set(float64(len(results)))
+
+	for _, result := range results {
+		rawTx, err := RPCClient.GetRawTransaction(result)
+		if err != nil {
+			// Transactions can leave the mempool before they are fetched,
+			// give up on them after a few attempts
+			hash := result.String()
+			failCount[hash] += 1
+			Log.Errorln("Hash", hash, "has failed", failCount[hash], "times", err)
+			if failCount[hash] >= 3 {
+				delete(failCount, hash)
+			}
+			continue
+		}
+		delete(failCount, result.String())
+		rawTxMsg := rawTx.MsgTx()
+
+		data := make([]byte, 0, rawTxMsg.SerializeSize())
+		buf := bytes.NewBuffer(data)
+		rawTxMsg.Serialize(buf)
+
+		_, err = RPCClient.DecodeRawTransaction(buf.Bytes())
+		if err != nil {
+			Log.Errorln("Unable to decode mempool TX", result, err)
+			continue
+		}
+
+		for _, input := range rawTxMsg.TxIn {
+
+			// Mark every input as spent for N * 2 seconds
+			hash := input.PreviousOutPoint.Hash.String()
+			idx := input.PreviousOutPoint.Index
+			client.Set(
+				fmt.Sprintf("spent_tx_in_mempool:%s:%d", hash, idx), "1", time.Second*7,
+			)
+			Log.Infoln("Added hash", hash, "to mempool")
+		}
+
+	}
+	return nil
 }
 
-func OperateMempool() {
-	failCount := make(map[*chainhash.Hash]int)
-	for {
-		results, err := RPCClient.GetRawMempool()
+// SyncBlock records deposits to known addresses and spent outputs found in
+// block number i.
+func SyncBlock(i int64) error {
+	hash, err := RPCClient.GetBlockHash(i)
+	if err != nil {
+		return err
+	}
+	Log.Infoln("Syncing block", i, hash)
+	block, err := RPCClient.GetBlock(hash)
+	if err != nil {
+		return err
+	}
+
+	txs := block.Transactions()
+	for _, tk := range txs {
+		msgTx := tk.MsgTx()
+
+		data := make([]byte, 0, msgTx.SerializeSize())
+		buf := bytes.NewBuffer(data)
+		msgTx.Serialize(buf)
+
+		res2, err := RPCClient.DecodeRawTransaction(buf.Bytes())
 		if err != nil {
-			Error.Panic(err)
+			return err
 		}
 
-		for _, result := range results {
-			rawTx, err := RPCClient.GetRawTransaction(result)
-			if err != nil {
-				if val, ok := failCount[result]; ok {
-					if val >= 2 {
-						Error.Panic(err)
-					} else {
-						failCount[result] += 1
-					}
-				} else {
-					failCount[result] = 0
-				}
-				Error.Println("Hash", result, "has failed", failCount[result], "times")
-				continue
-			} else {
-				delete(failCount, result)
+		transactionId := res2.Txid
+		// Process spent inputs
+		for _, input := range res2.Vin {
+			inputTransaction := input.Txid
+			idx := input.Vout
+
+			// Try to fetch the transaction
+			idxStr := strconv.FormatUint(uint64(idx), 10)
+			var transaction Transaction
+			err := dbs.Model(&transaction).Where(
+				"uid = ?",
+				inputTransaction+":"+idxStr,
+			).Update("spent", true).Error
+
+			if err == nil {
+				Log.Infof("Marked transaction %s idx %d as spent", inputTransaction, idx)
 			}
-			rawTxMsg := rawTx.MsgTx()
 
-			data := make([]byte, 0, rawTxMsg.SerializeSize())
-			buf := bytes.NewBuffer(data)
-			rawTxMsg.Serialize(buf)
+		}
 
-			_, err = RPCClient.DecodeRawTransaction(buf.Bytes())
+		// Process unspent outputs. Addresses are extracted from the
+		// raw scripts so witness (P2WPKH) outputs are recognised too.
+		for n, output := range msgTx.TxOut {
+			_, addresses, _, err := txscript.ExtractPkScriptAddrs(output.PkScript, net)
 			if err != nil {
-				Error.Panic(err)
+				Log.Errorln("Unable to parse output script for TX", transactionId, err)
+				continue
 			}
+			for _, addr := range addresses {
+				address := addr.EncodeAddress()
 
-			for _, input := range rawTxMsg.TxIn {
+				// If address is not known, ignore
+				if seen, _ := client.SIsMember("known_addresses", address).Result(); !seen {
+					continue
+				}
 
-				// Mark every input as spent for N * 2 seconds
-				hash := input.PreviousOutPoint.Hash.String()
-				idx := input.PreviousOutPoint.Index
-				client.Set(
-					fmt.Sprintf("spent_tx_in_mempool:%s:%d", hash, idx), "1", time.Second*7,
-				)
-				Info.Println("Added hash", hash, "to mempool")
+				idx := uint32(n)
+				value := btcutil.Amount(output.Value).ToBTC()
+
+				idxStr := strconv.FormatUint(uint64(idx), 10)
+				transaction := &Transaction{
+					Uid:           transactionId + ":" + idxStr,
+					TransactionId: transactionId,
+					Idx:           idx,
+					Address:       address,
+					Amount:        value,
+					Spent:         false,
+				}
+				// Blocks are read again from the last synced one, only
+				// deposits not seen before are counted
+				if dbs.Create(transaction).Error == nil {
+					deposits.Inc()
+					depositAmount.Add(value)
+				}
+				Log.Infof("Address %s received %f funds from TX %s idx %d", address, value, transactionId, idx)
 			}
 
 		}
-		time.Sleep(time.Second * 5)
 	}
+	return nil
 }
 
 func main() {
 
+	viper.SetDefault("monitor.metrics_listen", ":9101")
+	go ServeMetrics(viper.GetString("monitor.metrics_listen"))
 	go OperateMempool()
 
 	for {
-		currentBlock := GetCurrentBlockCount()
-		lastSyncedBlock := GetLastSyncedBlock()
+		// RPC and redis hiccups are retried from the last synced block
+		currentBlock, err := RPCClient.GetBlockCount()
+		if err != nil {
+			Log.Errorln("Unable to get the block count", err)
+			time.Sleep(time.Second * 5)
+			continue
+		}
+		lastSyncedBlock, err := GetLastSyncedBlock()
+		if err != nil {
+			Log.Errorln("Unable to get the last synced block", err)
+			time.Sleep(time.Second * 5)
+			continue
+		}
+		syncedHeight.Set(float64(lastSyncedBlock))
+		tipLag.Set(float64(currentBlock - lastSyncedBlock))
 
 		if currentBlock == lastSyncedBlock {
-			Info.Println("Blocks are up to date, sleeping for 5s")
+			Log.Infoln("Blocks are up to date, sleeping for 5s")
 			time.Sleep(time.Second * 5)
 			continue
 		}
 
 		for i := lastSyncedBlock; i <= currentBlock; i++ {
-
-			hash, err := RPCClient.GetBlockHash(i)
-			if err != nil {
-				Error.Fatal(err)
-			}
-			Info.Println("Syncing block", i, hash)
-			block, err := RPCClient.GetBlock(hash)
-			if err != nil {
-				Error.Fatal(err)
+			if err := SyncBlock(i); err != nil {
+				Log.Errorln("Unable to sync block", i, err)
+				time.Sleep(time.Second * 5)
+				break
 			}
-
-			txs := block.Transactions()
-			for _, tk := range txs {
-				msgTx := tk.MsgTx()
-
-				data := make([]byte, 0, msgTx.SerializeSize())
-				buf := bytes.NewBuffer(data)
-				msgTx.Serialize(buf)
-
-				res2, err := RPCClient.DecodeRawTransaction(buf.Bytes())
-				if err != nil {
-					Error.Fatal(err)
-				}
-
-				transactionId := res2.Txid
-				// Process spent inputs
-				for _, input := range res2.Vin {
-					inputTransaction := input.Txid
-					idx := input.Vout
-
-					// Try to fetch the transaction
-					idxStr := strconv.FormatUint(uint64(idx), 10)
-					var transaction Transaction
-					err := dbs.Model(&transaction).Where(
-						"uid = ?",
-						inputTransaction+":"+idxStr,
-					).Update("spent", true).Error
-
-					if err == nil {
-						Info.Printf("Marked transaction %s idx %d as spent", inputTransaction, idx)
-					}
-
-				}
-
-				// Process unspent outputs
-				for _, output := range res2.Vout {
-					for _, address := range output.ScriptPubKey.Addresses {
-
-						// If address is not known, ignore
-						if seen, _ := client.SIsMember("known_addresses", address).Result(); !seen {
-							continue
-						}
-
-						idx := output.N
-						value := output.Value
-
-						idxStr := strconv.FormatUint(uint64(idx), 10)
-						transaction := &Transaction{
-							Uid:           transactionId + ":" + idxStr,
-							TransactionId: transactionId,
-							Idx:           idx,
-							Address:       address,
-							Amount:        value,
-							Spent:         false,
-						}
-						dbs.Create(transaction)
-						Info.Printf("Address %s received %f funds from TX %s idx %d\n", address, value, transactionId, idx)
-					}
-
-				}
-			}
-			client.Set("last_synced_block", i, 0)
-			if err != nil {
-				Error.Fatal(err)
+			if err := client.Set("last_synced_block", i, 0).Err(); err != nil {
+				Log.Errorln("Unable to record synced block", i, err)
+				time.Sleep(time.Second * 5)
+				break
 			}
+			syncedHeight.Set(float64(i))
+			tipLag.Set(float64(currentBlock - i))
 		}
 	}
 }
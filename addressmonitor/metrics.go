@@ -0,0 +1,44 @@
+package main
+
+import "net/http"
+import "github.com/prometheus/client_golang/prometheus"
+import "github.com/prometheus/client_golang/prometheus/promhttp"
+
+var (
+	syncedHeight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mdp_monitor_synced_height",
+		Help: "Height of the last block processed.",
+	})
+
+	tipLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mdp_monitor_chain_tip_lag_blocks",
+		Help: "Blocks between the chain tip and the last block processed.",
+	})
+
+	mempoolSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mdp_monitor_mempool_transactions",
+		Help: "Transactions in the node mempool at the last poll.",
+	})
+
+	deposits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mdp_monitor_deposits_total",
+		Help: "Outputs paying a known address.",
+	})
+
+	depositAmount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mdp_monitor_deposits_btc_total",
+		Help: "BTC received by known addresses.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(syncedHeight, tipLag, mempoolSize, deposits, depositAmount)
+}
+
+// ServeMetrics exposes /metrics on addr, forever.
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	Log.Infoln("Serving metrics on", addr)
+	Log.Errorln(http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,221 @@
+package main
+
+import "io/ioutil"
+import "net/http"
+import "strings"
+import "github.com/gorilla/mux"
+import "github.com/sirupsen/logrus"
+
+const API_PREFIX = "/api/v1"
+
+// APIError is the body of every failed request, wrapped in ErrorResponse.
+// Code is stable for clients to match on, Message is meant for people.
+type APIError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+var errorCodes = map[int]string{
+	400: "invalid_request",
+	401: "unauthorized",
+	403: "forbidden",
+	404: "not_found",
+	405: "method_not_allowed",
+	409: "conflict",
+	429: "rate_limited",
+	500: "internal_error",
+	503: "unavailable",
+}
+
+// ErrorCode returns the error code matching an HTTP status.
+func ErrorCode(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return "internal_error"
+	}
+	return "invalid_request"
+}
+
+func NewError(status int, message string) *ErrorResponse {
+	return &ErrorResponse{
+		Error: APIError{
+			Code:    ErrorCode(status),
+			Message: message,
+		},
+	}
+}
+
+// WithDetails attaches machine readable details to the error.
+func (e *ErrorResponse) WithDetails(details interface{}) *ErrorResponse {
+	e.Error.Details = details
+	return e
+}
+
+// WriteError writes an error object with status.
+func WriteError(w http.ResponseWriter, log *logrus.Entry, status int, message string) {
+	WriteJSON(w, log, status, NewError(status, message))
+}
+
+// RecoverMiddleware turns a panicking handler into a 500 instead of a
+// dropped connection.
+func RecoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				RequestLog(r).Errorln("Recovered from panic:", err)
+				WriteError(w, RequestLog(r), 500, "internal error")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// legacyWriter marks responses of the unversioned aliases, WriteJSON gives
+// them the payloads they had before /api/v1.
+type legacyWriter struct {
+	http.ResponseWriter
+}
+
+// legacyPayload turns a /api/v1 response back into its unversioned shape:
+// errors as a bare message, lists as bare arrays and a capitalised State.
+func legacyPayload(data interface{}) interface{} {
+	switch body := data.(type) {
+	case *ErrorResponse:
+		legacy := map[string]string{
+			"error": body.Error.Message,
+		}
+		if details, ok := body.Error.Details.(map[string]string); ok {
+			for key, value := range details {
+				legacy[key] = value
+			}
+		}
+		return legacy
+	case map[string]interface{}:
+		if len(body) == 1 {
+			for _, key := range []string{"tiles", "addresses", "bookings", "api_keys"} {
+				if list, ok := body[key]; ok {
+					return list
+				}
+			}
+		}
+		if state, ok := body["state"]; ok {
+			legacy := make(map[string]interface{}, len(body))
+			for key, value := range body {
+				legacy[key] = value
+			}
+			delete(legacy, "state")
+			legacy["State"] = state
+			return legacy
+		}
+	case map[string]string:
+		if state, ok := body["state"]; ok && len(body) == 1 {
+			return map[string]string{
+				"State": state,
+			}
+		}
+	}
+	return data
+}
+
+// Deprecated serves the unversioned aliases of legacy with their old
+// payloads, telling clients which /api/v1 route replaces the one they
+// called.
+func Deprecated(legacy *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var match mux.RouteMatch
+		if legacy.Match(r, &match) && match.Route != nil {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+API_PREFIX+r.URL.Path+">; rel=\"successor-version\"")
+			w = legacyWriter{w}
+		}
+		legacy.ServeHTTP(w, r)
+	})
+}
+
+// apiNotFound answers unknown API routes with an error object and leaves
+// everything else to the default not found page.
+func apiNotFound(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, API_PREFIX+"/") {
+		WriteError(w, RequestLog(r), 404, "no such endpoint")
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func apiMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, RequestLog(r), 405, "method not allowed")
+}
+
+// APIRoute is one endpoint of the JSON API.
+type APIRoute struct {
+	Method  string
+	Path    string
+	Handler http.HandlerFunc
+}
+
+// APIRouteTable lists the endpoints served for the configured payment mode,
+// paths are relative to API_PREFIX. api/openapi.json documents each of them.
+func (s *Server) APIRouteTable() []APIRoute {
+	limits := s.config.RateLimit
+	routes := []APIRoute{
+		{"GET", "/openapi.json", OpenAPIHandler},
+		{"GET", "/price", s.PriceMiddleware},
+		{"GET", "/tiles", s.AuthMiddleware(ResponseByReturnHandler(s.TileHandler))},
+		{"POST", "/tile", s.AuthMiddleware(s.RateLimited("lock", limits.Lock, ResponseByReturnHandler(s.TileLockHandler)))},
+		{"DELETE", "/tile", s.AuthMiddleware(ResponseByReturnHandler(s.TileReleaseHandler))},
+		{"POST", "/tile/heartbeat", s.AuthMiddleware(ResponseByReturnHandler(s.TileHeartbeatHandler))},
+		{"POST", "/tile/message", s.AuthMiddleware(ResponseByReturnHandler(s.TileEditHandler))},
+		{"GET", "/account", s.AuthMiddleware(CookieOnly(ResponseByReturnHandler(s.AccountHandler)))},
+		{"POST", "/account/register", s.AuthMiddleware(CookieOnly(s.RateLimited("login", limits.Login, ResponseByReturnHandler(s.AccountRegisterHandler))))},
+		{"POST", "/account/login", s.AuthMiddleware(CookieOnly(s.RateLimited("login", limits.Login, ResponseByReturnHandler(s.AccountLoginHandler))))},
+		{"POST", "/account/logout", s.AuthMiddleware(CookieOnly(ResponseByReturnHandler(s.AccountLogoutHandler)))},
+		{"POST", "/account/wallet", s.AuthMiddleware(CookieOnly(ResponseByReturnHandler(s.AccountWalletHandler)))},
+		{"GET", "/apikeys", s.AuthMiddleware(CookieOnly(ResponseByReturnHandler(s.ApiKeysHandler)))},
+		{"POST", "/apikeys", s.AuthMiddleware(CookieOnly(ResponseByReturnHandler(s.ApiKeyCreateHandler)))},
+		{"DELETE", "/apikeys/{id}", s.AuthMiddleware(CookieOnly(ResponseByReturnHandler(s.ApiKeyRevokeHandler)))},
+	}
+	if s.config.Business.PaymentMode == PAYMENT_MODE_INVOICE {
+		return append(routes, []APIRoute{
+			{"POST", "/invoice", s.AuthMiddleware(s.RateLimited("purchase", limits.Purchase, ResponseByReturnHandler(s.InvoiceHandler)))},
+			{"GET", "/invoice/{address}", s.AuthMiddleware(ResponseByReturnHandler(s.InvoiceStatusHandler))},
+		}...)
+	}
+	return append(routes, []APIRoute{
+		{"GET", "/addresses", s.AuthMiddleware(ResponseByReturnHandler(s.AddressesHandler))},
+		{"GET", "/addresses/{frame}/qr", s.AuthMiddleware(s.AddressQRHandler)},
+		{"POST", "/purchase", s.AuthMiddleware(s.RateLimited("purchase", limits.Purchase, ResponseByReturnHandler(s.TilePurchasehandler)))},
+		{"POST", "/renew", s.AuthMiddleware(s.RateLimited("purchase", limits.Purchase, ResponseByReturnHandler(s.TileRenewHandler)))},
+		{"POST", "/bookings", s.AuthMiddleware(s.RateLimited("purchase", limits.Purchase, ResponseByReturnHandler(s.BookingHandler)))},
+		{"GET", "/bookings/{frame}", s.AuthMiddleware(ResponseByReturnHandler(s.BookingCalendarHandler))},
+		{"GET", "/auction/{frame}", s.AuthMiddleware(ResponseByReturnHandler(s.AuctionHandler))},
+		{"POST", "/auction/{frame}/bid", s.AuthMiddleware(s.RateLimited("purchase", limits.Purchase, ResponseByReturnHandler(s.AuctionBidHandler)))},
+	}...)
+}
+
+// APIRoutes registers the JSON API on r. main mounts it under /api/v1 and,
+// while clients move over, behind Deprecated at the root.
+func (s *Server) APIRoutes(r *mux.Router) {
+	r.MethodNotAllowedHandler = http.HandlerFunc(apiMethodNotAllowed)
+	for _, route := range s.APIRouteTable() {
+		r.HandleFunc(route.Path, route.Handler).Methods(route.Method)
+	}
+}
+
+// OpenAPIHandler serves the OpenAPI 3 description of the API.
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	spec, err := ioutil.ReadFile(currentDirectory + "/api/openapi.json")
+	if err != nil {
+		RequestLog(r).Errorln("Unable to read OpenAPI spec:", err)
+		WriteError(w, RequestLog(r), 500, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(spec)
+}
@@ -0,0 +1,122 @@
+package main
+
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+import "github.com/gorilla/mux"
+
+func TestErrorResponse(t *testing.T) {
+	data, err := json.Marshal(NewError(409, "Tile has a pending invoice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"error":{"code":"conflict","message":"Tile has a pending invoice"}}`
+	if string(data) != expected {
+		t.Errorf("got %s, want %s", data, expected)
+	}
+
+	if code := ErrorCode(418); code != "invalid_request" {
+		t.Errorf("unknown client error got code %q", code)
+	}
+	if code := ErrorCode(502); code != "internal_error" {
+		t.Errorf("unknown server error got code %q", code)
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	handler := RecoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/tiles", nil))
+	if w.Code != 500 {
+		t.Errorf("got status %d", w.Code)
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got content type %q", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestDeprecatedAliases(t *testing.T) {
+	legacy := mux.NewRouter()
+	legacy.HandleFunc("/tiles", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	legacy.NotFoundHandler = http.HandlerFunc(apiNotFound)
+	handler := Deprecated(legacy)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/tiles", nil))
+	if w.Code != 200 || w.Header().Get("Deprecation") != "true" {
+		t.Errorf("alias not served as deprecated, status %d", w.Code)
+	}
+	if link := w.Header().Get("Link"); link != `</api/v1/tiles>; rel="successor-version"` {
+		t.Errorf("got link %q", link)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/nothing", nil))
+	if w.Code != 404 || w.Header().Get("Deprecation") != "" {
+		t.Errorf("unknown API route got status %d", w.Code)
+	}
+	var body ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error.Code != "not_found" {
+		t.Errorf("unknown API route got body %s", w.Body.String())
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	r := mux.NewRouter()
+	r.MethodNotAllowedHandler = http.HandlerFunc(apiMethodNotAllowed)
+	r.HandleFunc("/tile", func(w http.ResponseWriter, r *http.Request) {}).Methods("POST")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/tile", nil))
+	if w.Code != 405 {
+		t.Errorf("got status %d", w.Code)
+	}
+	var body ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error.Code != "method_not_allowed" {
+		t.Errorf("got body %s", w.Body.String())
+	}
+}
+
+func TestLegacyPayloads(t *testing.T) {
+	legacy := mux.NewRouter()
+	legacy.HandleFunc("/tiles", func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, RequestLog(r), 200, map[string]interface{}{
+			"tiles": []string{"OPEN"},
+		})
+	}).Methods("GET")
+	legacy.HandleFunc("/tile", func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, RequestLog(r), 200, map[string]interface{}{
+			"state": "LOCKED_BY_CURRENT_USER",
+		})
+	}).Methods("POST")
+	legacy.HandleFunc("/purchase", func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, RequestLog(r), 400, "funds are insufficient")
+	}).Methods("POST")
+	handler := Deprecated(legacy)
+
+	expected := map[string]string{
+		"GET /tiles":     `["OPEN"]`,
+		"POST /tile":     `{"State":"LOCKED_BY_CURRENT_USER"}`,
+		"POST /purchase": `{"error":"funds are insufficient"}`,
+	}
+	for request, body := range expected {
+		parts := strings.SplitN(request, " ", 2)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(parts[0], parts[1], nil))
+		if got := strings.TrimSpace(w.Body.String()); got != body {
+			t.Errorf("%s: got %s, want %s", request, got, body)
+		}
+	}
+
+	// The same handler answers /api/v1 with the new shapes
+	w := httptest.NewRecorder()
+	legacy.ServeHTTP(w, httptest.NewRequest("GET", "/tiles", nil))
+	if got := strings.TrimSpace(w.Body.String()); got != `{"tiles":["OPEN"]}` {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/base64"
+import "encoding/hex"
+import "errors"
+import "net/http"
+import "strings"
+import "time"
+import "github.com/jinzhu/gorm"
+import "github.com/satori/go.uuid"
+import "github.com/sirupsen/logrus"
+
+// Read keys can only look, purchase keys can also lock, buy and edit tiles.
+const (
+	API_SCOPE_READ     = "read"
+	API_SCOPE_PURCHASE = "purchase"
+	API_KEY_PREFIX     = "mdp_"
+)
+
+var ErrInvalidApiKey = errors.New("Invalid or revoked API key")
+
+// ApiKey lets scripts act as a session without its cookie. Only the SHA-256
+// of the key is stored, keys are random so a slow hash buys nothing.
+type ApiKey struct {
+	gorm.Model
+	AccountID uint   `gorm:"index"`
+	SessionId string `gorm:"not null;index"`
+	Name      string
+	Prefix    string `gorm:"not null"`
+	Hash      string `gorm:"not null;unique_index"`
+	Scope     string `gorm:"not null"`
+	RevokedAt *time.Time
+}
+
+// Allows reports whether the key may be used for a request with method.
+func (k *ApiKey) Allows(method string) bool {
+	return k.Scope == API_SCOPE_PURCHASE || IsSafeMethod(method)
+}
+
+type ApiKeyManager struct {
+	dbs *gorm.DB
+}
+
+func NewApiKeyManager(dbs *gorm.DB) (*ApiKeyManager, error) {
+	if err := dbs.AutoMigrate(&ApiKey{}).Error; err != nil {
+		return nil, err
+	}
+	return &ApiKeyManager{
+		dbs: dbs,
+	}, nil
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create issues a key for the wallet of session. The key itself is only
+// returned here, it cannot be recovered later.
+func (km *ApiKeyManager) Create(accountId uint, session uuid.UUID, name string, scope string) (string, *ApiKey, error) {
+	if scope != API_SCOPE_READ && scope != API_SCOPE_PURCHASE {
+		return "", nil, errors.New("Scope must be read or purchase")
+	}
+	if len(name) > 64 {
+		return "", nil, errors.New("Name is too long")
+	}
+
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", nil, err
+	}
+	key := API_KEY_PREFIX + base64.RawURLEncoding.EncodeToString(data)
+
+	apiKey := &ApiKey{
+		AccountID: accountId,
+		SessionId: session.String(),
+		Name:      name,
+		Prefix:    key[:len(API_KEY_PREFIX)+6],
+		Hash:      hashApiKey(key),
+		Scope:     scope,
+	}
+	if err := km.dbs.Create(apiKey).Error; err != nil {
+		return "", nil, err
+	}
+	return key, apiKey, nil
+}
+
+// Authenticate returns the unrevoked key matching key.
+func (km *ApiKeyManager) Authenticate(key string) (*ApiKey, error) {
+	if !strings.HasPrefix(key, API_KEY_PREFIX) {
+		return nil, ErrInvalidApiKey
+	}
+
+	apiKey := &ApiKey{}
+	err := km.dbs.Where("hash = ? AND revoked_at IS NULL", hashApiKey(key)).First(apiKey).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrInvalidApiKey
+	}
+	return apiKey, err
+}
+
+// ownedBy scopes a query to the keys of an account or, for anonymous
+// sessions, to the keys of the session.
+func (km *ApiKeyManager) ownedBy(accountId uint, session uuid.UUID) *gorm.DB {
+	if accountId != 0 {
+		return km.dbs.Where("account_id = ?", accountId)
+	}
+	return km.dbs.Where("account_id = 0 AND session_id = ?", session.String())
+}
+
+// List returns the keys of an account, or of an anonymous session, newest
+// first.
+func (km *ApiKeyManager) List(accountId uint, session uuid.UUID) ([]ApiKey, error) {
+	var keys []ApiKey
+	err := km.ownedBy(accountId, session).Order("id desc").Find(&keys).Error
+	return keys, err
+}
+
+func (km *ApiKeyManager) Revoke(accountId uint, session uuid.UUID, id uint) error {
+	now := time.Now()
+	res := km.ownedBy(accountId, session).Model(&ApiKey{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", &now)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("Unknown API key")
+	}
+	return nil
+}
+
+// apiKeyAuth is the path AuthMiddleware takes for requests carrying an
+// Authorization header. The key stands in for the session cookie, so there
+// is no CSRF token to check and no session to mint.
+func (s *Server) apiKeyAuth(w http.ResponseWriter, r *http.Request, fn func(http.ResponseWriter, *http.Request, *UserDetails)) {
+	log := RequestLog(r)
+	unauthorized := func(message string) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		WriteError(w, log, 401, message)
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		unauthorized("expected a Bearer API key")
+		return
+	}
+
+	apiKey, err := s.apiKeys.Authenticate(strings.TrimPrefix(header, "Bearer "))
+	if err == ErrInvalidApiKey {
+		unauthorized(err.Error())
+		return
+	} else if err != nil {
+		log.Errorln("Unable to check API key:", err)
+		WriteError(w, log, 500, "internal error")
+		return
+	}
+
+	session, err := uuid.FromString(apiKey.SessionId)
+	if err != nil {
+		log.Errorln("API key has an invalid session:", err)
+		WriteError(w, log, 500, "internal error")
+		return
+	}
+
+	if !apiKey.Allows(r.Method) {
+		WriteError(w, log, 403, "API key is read only")
+		return
+	}
+
+	log = log.WithFields(logrus.Fields{
+		"session": session,
+		"api_key": apiKey.ID,
+	})
+	if apiKey.AccountID != 0 {
+		log = log.WithField("account", apiKey.AccountID)
+	}
+	details := &UserDetails{
+		SessionId: session,
+		AccountId: apiKey.AccountID,
+		ApiKey:    apiKey,
+		Keys:      s.keysWithLog(session, log),
+		Log:       log,
+	}
+
+	fn(w, r, details)
+}
+
+// CookieOnly keeps API keys away from fn, keys cannot manage accounts or
+// issue more keys.
+func CookieOnly(fn func(http.ResponseWriter, *http.Request, *UserDetails)) func(http.ResponseWriter, *http.Request, *UserDetails) {
+	return func(w http.ResponseWriter, r *http.Request, details *UserDetails) {
+		if details.ApiKey != nil {
+			WriteError(w, details.Log, 403, "not available with an API key")
+			return
+		}
+		fn(w, r, details)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import "net/http"
+import "net/http/httptest"
+import "testing"
+import "github.com/satori/go.uuid"
+
+func TestApiKeyAllows(t *testing.T) {
+	read := &ApiKey{Scope: API_SCOPE_READ}
+	if !read.Allows("GET") || read.Allows("POST") || read.Allows("DELETE") {
+		t.Error("read key must only allow safe methods")
+	}
+	purchase := &ApiKey{Scope: API_SCOPE_PURCHASE}
+	if !purchase.Allows("GET") || !purchase.Allows("POST") {
+		t.Error("purchase key must allow every method")
+	}
+}
+
+func TestApiKeyCreateScope(t *testing.T) {
+	km := &ApiKeyManager{}
+	if _, _, err := km.Create(0, uuid.NewV4(), "script", "admin"); err == nil {
+		t.Error("unknown scope accepted")
+	}
+}
+
+func TestCookieOnly(t *testing.T) {
+	called := false
+	handler := CookieOnly(func(w http.ResponseWriter, r *http.Request, details *UserDetails) {
+		called = true
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/apikeys", nil), &UserDetails{
+		ApiKey: &ApiKey{Scope: API_SCOPE_PURCHASE},
+		Log:    Log.WithField("test", true),
+	})
+	if called || w.Code != 403 {
+		t.Errorf("API key reached a cookie only handler, status %d", w.Code)
+	}
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/apikeys", nil), &UserDetails{
+		Log: Log.WithField("test", true),
+	})
+	if !called {
+		t.Error("cookie session rejected")
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import "encoding/json"
+import "errors"
+import "math"
+import "sort"
+import "strconv"
+import "sync"
+import "time"
+import "gopkg.in/redis.v4"
+import "github.com/satori/go.uuid"
+
+const STATE_AUCTION = "AUCTION"
+
+// Every bid must beat the highest one by at least a satoshi.
+const MIN_BID_INCREMENT_SATOSHIS = 1
+
+type AuctionConfig struct {
+	Tiles      []int `mapstructure:"tiles"`
+	WindowMins int   `mapstructure:"window_mins"`
+}
+
+type Bid struct {
+	Session  string    `json:"session"`
+	Amount   float64   `json:"amount"`
+	Message  string    `json:"message"`
+	PlacedAt time.Time `json:"placed_at"`
+}
+
+// PublicBid is a bid as shown to other bidders, without the session.
+type PublicBid struct {
+	Amount   float64   `json:"amount"`
+	PlacedAt time.Time `json:"placed_at"`
+	Mine     bool      `json:"mine"`
+}
+
+type Auction struct {
+	Tile         int          `json:"frame_number"`
+	ReservePrice float64      `json:"reserve_price"`
+	EndsAt       *time.Time   `json:"ends_at"`
+	Settled      bool         `json:"settled"`
+	Bids         []*PublicBid `json:"bids"`
+}
+
+// AuctionManager runs timed auctions on a set of tiles. The first bid opens
+// the auction window, every bid must be covered by the bidder's balance on
+// that frame, and once the window closes the highest bid that can still pay
+// goes through the regular purchase path.
+type AuctionManager struct {
+	client   *redis.Client
+	tiles    *TileManager
+	quoter   *PriceQuoter
+	window   time.Duration
+	auctions map[int]bool
+	keysFor  func(uuid.UUID) AddressGenerator
+	purchase func(int, uuid.UUID, AddressGenerator, string, float64) (string, error)
+	lock     sync.Mutex
+}
+
+func NewAuctionManager(client *redis.Client, tiles *TileManager, quoter *PriceQuoter, config AuctionConfig, keysFor func(uuid.UUID) AddressGenerator, purchase func(int, uuid.UUID, AddressGenerator, string, float64) (string, error)) (*AuctionManager, error) {
+	auctions := make(map[int]bool, len(config.Tiles))
+	for _, tile := range config.Tiles {
+		if tile < 0 || tile >= tiles.NumTiles {
+			return nil, errors.New("Auction configured for invalid tile " + strconv.Itoa(tile))
+		}
+		auctions[tile] = true
+	}
+	if len(auctions) > 0 && config.WindowMins <= 0 {
+		return nil, errors.New("Auction window must be positive")
+	}
+
+	return &AuctionManager{
+		client:   client,
+		tiles:    tiles,
+		quoter:   quoter,
+		window:   time.Duration(config.WindowMins) * time.Minute,
+		auctions: auctions,
+		keysFor:  keysFor,
+		purchase: purchase,
+	}, nil
+}
+
+func (am *AuctionManager) IsAuctioned(tile int) bool {
+	return am.auctions[tile]
+}
+
+func (am *AuctionManager) keyForAuction(tile int) string {
+	return "auction:" + strconv.Itoa(tile)
+}
+
+func (am *AuctionManager) keyForBids(tile int) string {
+	return "auction_bids:" + strconv.Itoa(tile)
+}
+
+func (am *AuctionManager) bids(tile int) ([]*Bid, error) {
+	raw, err := am.client.LRange(am.keyForBids(tile), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	bids := make([]*Bid, len(raw))
+	for i, data := range raw {
+		bids[i] = &Bid{}
+		if err := json.Unmarshal([]byte(data), bids[i]); err != nil {
+			return nil, err
+		}
+	}
+	return bids, nil
+}
+
+func toSatoshis(amount float64) int64 {
+	return int64(math.Floor(amount*1e8 + 0.5))
+}
+
+// checkBid verifies amount covers the reserve price and beats every bid
+// placed so far by the minimum increment.
+func checkBid(amount float64, reservePrice float64, bids []*Bid) error {
+	if toSatoshis(amount) < toSatoshis(reservePrice) {
+		return errors.New("Bid is below the reserve price")
+	}
+	for _, bid := range bids {
+		if toSatoshis(amount) < toSatoshis(bid.Amount)+MIN_BID_INCREMENT_SATOSHIS {
+			return errors.New("Bid must be higher than the current highest bid")
+		}
+	}
+	return nil
+}
+
+// rankBids orders bids from the highest down, earlier bids first on ties.
+func rankBids(bids []*Bid) []*Bid {
+	ranked := make([]*Bid, len(bids))
+	copy(ranked, bids)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Amount > ranked[j].Amount
+	})
+	return ranked
+}
+
+// settleBids tries bids from the highest down until one pays, skipping
+// bidders who no longer have the funds. A booking on the tile ends the
+// auction without a winner, no bid could be published.
+func settleBids(bids []*Bid, purchase func(*Bid) (string, error)) (*Bid, string) {
+	for _, bid := range rankBids(bids) {
+		txid, err := purchase(bid)
+		if err == ErrTileBooked {
+			return nil, ""
+		} else if err != nil {
+			Log.Infof("Auction bid of %f failed: %s", bid.Amount, err)
+			continue
+		}
+		return bid, txid
+	}
+	return nil, ""
+}
+
+// Get returns the current (or last settled) auction on a tile, marking the
+// bids placed by viewer.
+func (am *AuctionManager) Get(tile int, viewer uuid.UUID) (*Auction, error) {
+	if !am.IsAuctioned(tile) {
+		return nil, errors.New("This tile is not auctioned")
+	}
+
+	reservePrice, err := am.quoter.PriceForTile(tile)
+	if err != nil {
+		return nil, err
+	}
+	auction := &Auction{
+		Tile:         tile,
+		ReservePrice: reservePrice,
+		Bids:         []*PublicBid{},
+	}
+	fields, err := am.client.HGetAll(am.keyForAuction(tile)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return auction, nil
+	}
+
+	endsAt, err := strconv.ParseInt(fields["ends_at"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	endsAtTime := time.Unix(endsAt, 0)
+	auction.EndsAt = &endsAtTime
+	auction.Settled = fields["settled"] == "1"
+
+	bids, err := am.bids(tile)
+	if err != nil {
+		return nil, err
+	}
+	for _, bid := range bids {
+		auction.Bids = append(auction.Bids, &PublicBid{
+			Amount:   bid.Amount,
+			PlacedAt: bid.PlacedAt,
+			Mine:     bid.Session == viewer.String(),
+		})
+	}
+	return auction, nil
+}
+
+// Bid places a bid, opening a new auction window if none is running.
+func (am *AuctionManager) Bid(tile int, session uuid.UUID, keys AddressGenerator, amount float64, message string) (*Auction, error) {
+	if !am.IsAuctioned(tile) {
+		return nil, errors.New("This tile is not auctioned")
+	}
+	if len(message) == 0 {
+		return nil, errors.New("Body is empty, impossible to set")
+	}
+	reservePrice, err := am.quoter.PriceForTile(tile)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBid(amount, reservePrice, nil); err != nil {
+		return nil, err
+	}
+
+	// Bids are backed by the bidder's balance on the frame
+	address := keys.MakeAddresses(am.tiles.NumTiles)[tile]
+	if keys.GetBalanceForAddress(address) < amount {
+		return nil, errors.New("funds are insufficient")
+	}
+
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	if state, _ := am.tiles.Client.Get(am.tiles.keyForTile(tile)).Result(); state == "PURCHASED" {
+		return nil, errors.New("Tile is already purchased")
+	}
+
+	fields, err := am.client.HGetAll(am.keyForAuction(tile)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// Start a new auction if none is running
+	now := time.Now()
+	if len(fields) == 0 || fields["settled"] == "1" {
+		endsAt := now.Add(am.window)
+		err := am.client.Del(am.keyForAuction(tile), am.keyForBids(tile)).Err()
+		if err != nil {
+			return nil, err
+		}
+		err = am.client.HMSet(am.keyForAuction(tile), map[string]string{
+			"ends_at": strconv.FormatInt(endsAt.Unix(), 10),
+			"settled": "0",
+		}).Err()
+		if err != nil {
+			return nil, err
+		}
+		if err := am.client.SAdd("running_auctions", strconv.Itoa(tile)).Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		endsAt, err := strconv.ParseInt(fields["ends_at"], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if now.Unix() >= endsAt {
+			return nil, errors.New("Auction has ended")
+		}
+
+		bids, err := am.bids(tile)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBid(amount, reservePrice, bids); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.Marshal(&Bid{
+		Session:  session.String(),
+		Amount:   amount,
+		Message:  message,
+		PlacedAt: now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := am.client.RPush(am.keyForBids(tile), string(data)).Err(); err != nil {
+		return nil, err
+	}
+	Log.Infof("Bid of %f placed on tile %d", amount, tile)
+
+	return am.Get(tile, session)
+}
+
+// Settle closes every auction whose window has passed through settleBids.
+// Purchases check bookings, a booked tile is never published over.
+func (am *AuctionManager) Settle() error {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	running, err := am.client.SMembers("running_auctions").Result()
+	if err != nil {
+		return err
+	}
+
+	for _, tileStr := range running {
+		tile, err := strconv.Atoi(tileStr)
+		if err != nil {
+			return err
+		}
+		endsAt, err := am.client.HGet(am.keyForAuction(tile), "ends_at").Int64()
+		if err != nil {
+			return err
+		}
+		if time.Now().Unix() < endsAt {
+			continue
+		}
+
+		bids, err := am.bids(tile)
+		if err != nil {
+			return err
+		}
+
+		// am.lock only covers this process, the server whose SREM removes
+		// the auction is the one that settles it
+		claimed, err := am.client.SRem("running_auctions", tileStr).Result()
+		if err != nil {
+			return err
+		}
+		if claimed == 0 {
+			continue
+		}
+
+		winner, txid := settleBids(bids, func(bid *Bid) (string, error) {
+			session, err := uuid.FromString(bid.Session)
+			if err != nil {
+				return "", err
+			}
+
+			am.tiles.PurchaseLock.Lock()
+			defer am.tiles.PurchaseLock.Unlock()
+			return am.purchase(tile, session, am.keysFor(session), bid.Message, bid.Amount)
+		})
+		if winner != nil {
+			Log.Infof("Auction on tile %d won with %f, TX %s", tile, winner.Amount, txid)
+			am.client.HSet(am.keyForAuction(tile), "txid", txid)
+		} else {
+			Log.Infof("Auction on tile %d ended without a winner", tile)
+		}
+
+		am.client.HSet(am.keyForAuction(tile), "settled", "1")
+	}
+	return nil
+}
+
+// Watch settles auctions periodically, forever.
+func (am *AuctionManager) Watch(interval time.Duration) {
+	runEvery(interval, am.Settle)
+}
@@ -0,0 +1,147 @@
+package main
+
+import "encoding/json"
+import "errors"
+import "strconv"
+import "sync"
+import "testing"
+import "time"
+import "github.com/satori/go.uuid"
+
+func TestRankBids(t *testing.T) {
+	bids := []*Bid{
+		{Session: "a", Amount: 0.01},
+		{Session: "b", Amount: 0.03},
+		{Session: "c", Amount: 0.02},
+		{Session: "d", Amount: 0.03},
+	}
+	ranked := rankBids(bids)
+
+	expected := []string{"b", "d", "c", "a"}
+	for i, session := range expected {
+		if ranked[i].Session != session {
+			t.Errorf("position %d: got %s, want %s", i, ranked[i].Session, session)
+		}
+	}
+	if bids[0].Session != "a" {
+		t.Error("bids reordered in place")
+	}
+}
+
+func TestCheckBid(t *testing.T) {
+	bids := []*Bid{{Amount: 0.01}, {Amount: 0.02}}
+
+	if err := checkBid(0.0005, 0.001, nil); err == nil {
+		t.Error("bid below the reserve price accepted")
+	}
+	if err := checkBid(0.001, 0.001, nil); err != nil {
+		t.Error("bid at the reserve price rejected:", err)
+	}
+	if err := checkBid(0.02, 0.001, bids); err == nil {
+		t.Error("bid matching the highest bid accepted")
+	}
+	if err := checkBid(0.015, 0.001, bids); err == nil {
+		t.Error("bid below the highest bid accepted")
+	}
+	if err := checkBid(0.02000001, 0.001, bids); err != nil {
+		t.Error("bid one satoshi above the highest bid rejected:", err)
+	}
+}
+
+func TestSettleBids(t *testing.T) {
+	bids := []*Bid{
+		{Session: "low", Amount: 0.01},
+		{Session: "broke", Amount: 0.05},
+		{Session: "high", Amount: 0.03},
+	}
+
+	var tried []string
+	winner, txid := settleBids(bids, func(bid *Bid) (string, error) {
+		tried = append(tried, bid.Session)
+		if bid.Session == "broke" {
+			return "", errors.New("funds are insufficient")
+		}
+		return "tx-" + bid.Session, nil
+	})
+	if winner == nil || winner.Session != "high" || txid != "tx-high" {
+		t.Errorf("got winner %v, %s, want the highest funded bid", winner, txid)
+	}
+	if len(tried) != 2 || tried[0] != "broke" {
+		t.Errorf("tried %v, want the unfunded top bid skipped then the next one", tried)
+	}
+
+	winner, _ = settleBids(bids, func(bid *Bid) (string, error) {
+		return "", errors.New("funds are insufficient")
+	})
+	if winner != nil {
+		t.Error("winner without funds")
+	}
+
+	tried = nil
+	winner, _ = settleBids(bids, func(bid *Bid) (string, error) {
+		tried = append(tried, bid.Session)
+		return "", ErrTileBooked
+	})
+	if winner != nil || len(tried) != 1 {
+		t.Errorf("booked tile tried %v, want settlement to stop", tried)
+	}
+}
+
+func TestSettleClaimsAuction(t *testing.T) {
+	if err := client.Ping().Err(); err != nil {
+		t.Skip("redis is not available:", err)
+	}
+
+	tiles := NewTileManager(1000, client, 0, 0, 0)
+	var lock sync.Mutex
+	purchases := 0
+	purchase := func(tile int, session uuid.UUID, keys AddressGenerator, message string, amount float64) (string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		purchases++
+		return "tx-" + strconv.Itoa(purchases), nil
+	}
+	config := AuctionConfig{Tiles: []int{950}, WindowMins: 1}
+	keysFor := func(uuid.UUID) AddressGenerator { return nil }
+
+	// Two servers sharing the same redis
+	servers := make([]*AuctionManager, 2)
+	for i := range servers {
+		am, err := NewAuctionManager(client, tiles, nil, config, keysFor, purchase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = am
+	}
+
+	am := servers[0]
+	client.Del(am.keyForAuction(950), am.keyForBids(950))
+	client.HMSet(am.keyForAuction(950), map[string]string{
+		"ends_at": strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10),
+		"settled": "0",
+	})
+	for _, amount := range []float64{0.01, 0.02} {
+		data, _ := json.Marshal(&Bid{Session: uuid.NewV4().String(), Amount: amount, Message: "hello"})
+		client.RPush(am.keyForBids(950), string(data))
+	}
+	client.SAdd("running_auctions", "950")
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *AuctionManager) {
+			defer wg.Done()
+			if err := server.Settle(); err != nil {
+				t.Error(err)
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	if purchases != 1 {
+		t.Errorf("auction paid %d times", purchases)
+	}
+	if settled, _ := client.HGet(am.keyForAuction(950), "settled").Result(); settled != "1" {
+		t.Error("auction not settled")
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import "errors"
+import "math"
+import "strconv"
+import "sync"
+import "time"
+import "gopkg.in/redis.v4"
+import "github.com/satori/go.uuid"
+
+const STATE_BOOKED = "BOOKED"
+
+var ErrTileBooked = errors.New("This tile is booked before the ad would end")
+
+const (
+	BOOKING_SCHEDULED = "SCHEDULED"
+	BOOKING_ACTIVE    = "ACTIVE"
+)
+
+// BOOKING_LOCK_LIFE bounds how long a server that died mid booking keeps
+// the tile from being booked.
+const BOOKING_LOCK_LIFE = time.Minute
+
+type Booking struct {
+	Id        string    `json:"id"`
+	Tile      int       `json:"frame_number"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Status    string    `json:"status"`
+	Price     float64   `json:"price"`
+	TxId      string    `json:"transaction_id,omitempty"`
+	Mine      bool      `json:"mine"`
+	SessionId uuid.UUID `json:"-"`
+	Message   string    `json:"-"`
+}
+
+// BookingManager keeps a calendar of paid, non-overlapping future slots per
+// tile. Bookings are paid when made and activated by Watch when their slot
+// starts, expiring on their own at the end of the slot.
+type BookingManager struct {
+	client     *redis.Client
+	tiles      *TileManager
+	quoter     *PriceQuoter
+	auctions   *AuctionManager
+	adDuration time.Duration
+	maxAdvance time.Duration
+	pay        func(int, AddressGenerator, float64) (string, error)
+	lock       sync.Mutex
+}
+
+func NewBookingManager(client *redis.Client, tiles *TileManager, quoter *PriceQuoter, auctions *AuctionManager, adDuration time.Duration, maxAdvance time.Duration, pay func(int, AddressGenerator, float64) (string, error)) *BookingManager {
+	return &BookingManager{
+		client:     client,
+		tiles:      tiles,
+		quoter:     quoter,
+		auctions:   auctions,
+		adDuration: adDuration,
+		maxAdvance: maxAdvance,
+		pay:        pay,
+	}
+}
+
+func (bm *BookingManager) keyForCalendar(tile int) string {
+	return "bookings:" + strconv.Itoa(tile)
+}
+
+func (bm *BookingManager) keyForBooking(id string) string {
+	return "booking:" + id
+}
+
+// PriceForSlot charges the tile price for every started ad duration period.
+func (bm *BookingManager) PriceForSlot(tile int, start time.Time, end time.Time) (float64, error) {
+	price, err := bm.quoter.PriceForTile(tile)
+	if err != nil {
+		return 0, err
+	}
+	periods := math.Ceil(float64(end.Sub(start)) / float64(bm.adDuration))
+	return roundToSatoshis(price * periods), nil
+}
+
+func (bm *BookingManager) get(id string) (*Booking, error) {
+	fields, err := bm.client.HGetAll(bm.keyForBooking(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("Booking not found")
+	}
+
+	booking := &Booking{
+		Id:      id,
+		Status:  fields["status"],
+		TxId:    fields["txid"],
+		Message: fields["message"],
+	}
+	if booking.Tile, err = strconv.Atoi(fields["tile"]); err != nil {
+		return nil, err
+	}
+	start, err := strconv.ParseInt(fields["start"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	end, err := strconv.ParseInt(fields["end"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	booking.Start, booking.End = time.Unix(start, 0), time.Unix(end, 0)
+	if booking.Price, err = strconv.ParseFloat(fields["price"], 64); err != nil {
+		return nil, err
+	}
+	if booking.SessionId, err = uuid.FromString(fields["session"]); err != nil {
+		return nil, err
+	}
+	return booking, nil
+}
+
+// Calendar lists the bookings of a tile that have not ended yet, marking
+// the ones made by viewer.
+func (bm *BookingManager) Calendar(tile int, viewer uuid.UUID) ([]*Booking, error) {
+	ids, err := bm.client.ZRange(bm.keyForCalendar(tile), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	bookings := []*Booking{}
+	for _, id := range ids {
+		booking, err := bm.get(id)
+		if err != nil {
+			return nil, err
+		}
+		if booking.End.Before(now) {
+			continue
+		}
+		booking.Mine = uuid.Equal(booking.SessionId, viewer)
+		bookings = append(bookings, booking)
+	}
+	return bookings, nil
+}
+
+// Available reports whether no booking overlaps [from, to) on a tile.
+func (bm *BookingManager) Available(tile int, from time.Time, to time.Time) (bool, error) {
+	ids, err := bm.client.ZRangeByScore(bm.keyForCalendar(tile), redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(to.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return false, err
+	}
+
+	for _, id := range ids {
+		booking, err := bm.get(id)
+		if err != nil {
+			return false, err
+		}
+		if booking.End.After(from) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// busyUntil returns when the ad on a tile ends. A locked tile can still be
+// bought, so it stays busy for a whole ad after the lock expires.
+func (bm *BookingManager) busyUntil(tile int, now time.Time) (time.Time, error) {
+	key := bm.tiles.keyForTile(tile)
+	val, err := bm.client.Get(key).Result()
+	if err == redis.Nil {
+		return now, nil
+	} else if err != nil {
+		return now, err
+	}
+
+	ttl, err := bm.client.PTTL(key).Result()
+	if err != nil {
+		return now, err
+	}
+	if val != "PURCHASED" {
+		ttl += bm.adDuration
+	}
+	return now.Add(ttl), nil
+}
+
+// lockTile keeps every server from booking tile until the returned unlock
+// is called. bm.lock only covers this process.
+func (bm *BookingManager) lockTile(tile int) (func(), error) {
+	key := "booking_lock:" + strconv.Itoa(tile)
+	token := uuid.NewV4().String()
+	locked, err := bm.client.SetNX(key, token, BOOKING_LOCK_LIFE).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, errors.New("This tile is being booked, try again")
+	}
+	return func() {
+		if val, _ := bm.client.Get(key).Result(); val == token {
+			bm.client.Del(key)
+		}
+	}, nil
+}
+
+// Book pays for and reserves [start, end) on a tile.
+func (bm *BookingManager) Book(tile int, session uuid.UUID, keys AddressGenerator, start time.Time, end time.Time, message string) (*Booking, error) {
+	if err := ValidateMessage(message); err != nil {
+		return nil, err
+	}
+	if tile < 0 || tile >= bm.tiles.NumTiles {
+		return nil, errors.New("This tile is not available")
+	}
+	if bm.auctions != nil && bm.auctions.IsAuctioned(tile) {
+		return nil, errors.New("Auctioned tiles cannot be booked")
+	}
+
+	now := time.Now()
+	if !start.After(now) {
+		return nil, errors.New("Bookings must start in the future")
+	}
+	if !end.After(start) {
+		return nil, errors.New("Bookings must end after they start")
+	}
+	if start.After(now.Add(bm.maxAdvance)) {
+		return nil, errors.New("Bookings cannot start that far ahead")
+	}
+
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+
+	unlock, err := bm.lockTile(tile)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	available, err := bm.Available(tile, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if !available {
+		return nil, errors.New("Slot overlaps an existing booking")
+	}
+
+	// The ad currently running, or about to be bought, must be over by the
+	// time the slot starts
+	busyUntil, err := bm.busyUntil(tile, now)
+	if err != nil {
+		return nil, err
+	}
+	if busyUntil.After(start) {
+		return nil, errors.New("Slot overlaps the running ad")
+	}
+
+	price, err := bm.PriceForSlot(tile, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	booking := &Booking{
+		Id:        uuid.NewV4().String(),
+		Tile:      tile,
+		Start:     start,
+		End:       end,
+		Status:    BOOKING_SCHEDULED,
+		Price:     price,
+		Mine:      true,
+		SessionId: session,
+		Message:   message,
+	}
+
+	bm.tiles.PurchaseLock.Lock()
+	booking.TxId, err = bm.pay(tile, keys, booking.Price)
+	bm.tiles.PurchaseLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	key := bm.keyForBooking(booking.Id)
+	err = bm.client.HMSet(key, map[string]string{
+		"tile":    strconv.Itoa(tile),
+		"start":   strconv.FormatInt(start.Unix(), 10),
+		"end":     strconv.FormatInt(end.Unix(), 10),
+		"status":  booking.Status,
+		"price":   strconv.FormatFloat(booking.Price, 'f', 8, 64),
+		"txid":    booking.TxId,
+		"session": session.String(),
+		"message": message,
+	}).Err()
+	if err != nil {
+		return nil, err
+	}
+	bm.client.ExpireAt(key, end.Add(SESSION_LIFE))
+
+	err = bm.client.ZAdd(bm.keyForCalendar(tile), redis.Z{
+		Score:  float64(start.Unix()),
+		Member: booking.Id,
+	}).Err()
+	if err != nil {
+		return nil, err
+	}
+	Log.Infof("Booked tile %d from %s to %s", tile, start, end)
+	return booking, nil
+}
+
+// Activate publishes bookings whose slot has started and drops the ones
+// that have ended from the calendars.
+func (bm *BookingManager) Activate() error {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+
+	now := time.Now()
+	for tile := 0; tile < bm.tiles.NumTiles; tile++ {
+		ids, err := bm.client.ZRangeByScore(bm.keyForCalendar(tile), redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(now.Unix(), 10),
+		}).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			booking, err := bm.get(id)
+			if err != nil {
+				return err
+			}
+
+			if !booking.End.After(now) {
+				bm.client.ZRem(bm.keyForCalendar(tile), id)
+				continue
+			}
+			if booking.Status != BOOKING_SCHEDULED {
+				continue
+			}
+
+			// Only the server that claims the booking publishes it
+			key := bm.keyForBooking(id)
+			claimed, err := bm.client.HSetNX(key, "activating", "1").Result()
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				continue
+			}
+
+			bm.tiles.PurchaseLock.Lock()
+			err = bm.tiles.PurchaseTile(
+				tile, booking.Message, booking.End.Sub(now),
+				booking.SessionId, booking.TxId,
+			)
+			bm.tiles.PurchaseLock.Unlock()
+			if err != nil {
+				Log.Errorln("Unable to activate booking", id, err)
+				bm.client.HDel(key, "activating")
+				continue
+			}
+			bm.client.HSet(key, "status", BOOKING_ACTIVE)
+			Log.Infof("Activated booking %s on tile %d", id, tile)
+		}
+	}
+	return nil
+}
+
+// Watch activates bookings periodically, forever.
+func (bm *BookingManager) Watch(interval time.Duration) {
+	runEvery(interval, bm.Activate)
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+import "time"
+
+func TestBookingPriceForSlot(t *testing.T) {
+	pricer, _ := NewPricer(0.01, PricingConfig{})
+	quoter := NewPriceQuoter(pricer, nil, "")
+	bm := NewBookingManager(nil, nil, quoter, nil, time.Hour, time.Hour*24, nil)
+
+	start := time.Now()
+	expected := map[time.Duration]float64{
+		time.Minute * 30: 0.01,
+		time.Hour:        0.01,
+		time.Minute * 90: 0.02,
+	}
+	for length, price := range expected {
+		if res, _ := bm.PriceForSlot(0, start, start.Add(length)); res != price {
+			t.Errorf("%s: expected %f, got %f", length, price, res)
+		}
+	}
+}
+
+func TestBookingLockTile(t *testing.T) {
+	if err := client.Ping().Err(); err != nil {
+		t.Skip("redis is not available:", err)
+	}
+
+	// Two servers sharing the same redis
+	first := NewBookingManager(client, nil, nil, nil, time.Hour, time.Hour*24, nil)
+	second := NewBookingManager(client, nil, nil, nil, time.Hour, time.Hour*24, nil)
+	client.Del("booking_lock:960")
+
+	unlock, err := first.lockTile(960)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.lockTile(960); err == nil {
+		t.Error("tile booked by two servers at once")
+	}
+	unlock()
+
+	unlock, err = second.lockTile(960)
+	if err != nil {
+		t.Error("tile still locked after unlock:", err)
+	} else {
+		unlock()
+	}
+}
+
+func TestBookingPriceForSlotRounds(t *testing.T) {
+	pricer, _ := NewPricer(0.0001, PricingConfig{})
+	quoter := NewPriceQuoter(pricer, nil, "")
+	bm := NewBookingManager(nil, nil, quoter, nil, time.Hour, time.Hour*24, nil)
+
+	// 0.0001 * 3 leaves a fraction of a satoshi behind in floating point
+	start := time.Now()
+	if res, _ := bm.PriceForSlot(0, start, start.Add(time.Hour*3)); res != 0.0003 {
+		t.Errorf("expected 0.0003, got %v", res)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import "errors"
+import "fmt"
+import "os/user"
+import "path/filepath"
+import "strings"
+import "time"
+import "github.com/btcsuite/btcd/chaincfg"
+import "github.com/btcsuite/btcutil"
+import "github.com/sirupsen/logrus"
+import "github.com/spf13/viper"
+import "milliondollar/pkg/network"
+
+type BtcdConfig struct {
+	Host     string `mapstructure:"host"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	Network  string `mapstructure:"network"`
+	IsSimnet bool   `mapstructure:"is_simnet"`
+}
+
+type DBConfig struct {
+	Redis string     `mapstructure:"redis"`
+	PG    string     `mapstructure:"pg"`
+	Btcd  BtcdConfig `mapstructure:"btcd"`
+}
+
+type BookingConfig struct {
+	MaxAdvanceDays int `mapstructure:"max_advance_days"`
+}
+
+type BusinessConfig struct {
+	NAds              int           `mapstructure:"n_ads"`
+	AdCost            float64       `mapstructure:"ad_cost"`
+	AdTTLMins         int           `mapstructure:"ad_ttl_mins"`
+	Bank              string        `mapstructure:"bank"`
+	AddressType       string        `mapstructure:"address_type"`
+	PaymentMode       string        `mapstructure:"payment_mode"`
+	PaymentLabel      string        `mapstructure:"payment_label"`
+	Xpub              string        `mapstructure:"xpub"`
+	InvoiceTTLMins    int           `mapstructure:"invoice_ttl_mins"`
+	RenewPriorityMins int           `mapstructure:"renew_priority_mins"`
+	LockDurationMins  int           `mapstructure:"lock_duration_mins"`
+	MaxLockHoldMins   int           `mapstructure:"max_lock_hold_mins"`
+	MaxLocks          int           `mapstructure:"max_locks_per_session"`
+	Currency          string        `mapstructure:"currency"`
+	Pricing           PricingConfig `mapstructure:"pricing"`
+	Auction           AuctionConfig `mapstructure:"auction"`
+	Booking           BookingConfig `mapstructure:"booking"`
+}
+
+type CookieKeyPair struct {
+	Key1 string `mapstructure:"key1"`
+	Key2 string `mapstructure:"key2"`
+}
+
+// CookieConfig holds the session cookie keys. Key1 and Key2 sign new
+// cookies, OldKeys are kept so cookies signed before a rotation still
+// decode. Secure cookies are always used with TLS, set Secure when TLS is
+// terminated in front of the server.
+type CookieConfig struct {
+	Key1    string          `mapstructure:"key1"`
+	Key2    string          `mapstructure:"key2"`
+	OldKeys []CookieKeyPair `mapstructure:"old_keys"`
+	Secure  bool            `mapstructure:"secure"`
+}
+
+type SecurityConfig struct {
+	SeedKey         string   `mapstructure:"seed_key"`
+	SeedKeyFile     string   `mapstructure:"seed_key_file"`
+	OldSeedKeyFiles []string `mapstructure:"old_seed_key_files"`
+}
+
+type ServerConfig struct {
+	Listen              string `mapstructure:"listen"`
+	ReadTimeoutSecs     int    `mapstructure:"read_timeout_secs"`
+	WriteTimeoutSecs    int    `mapstructure:"write_timeout_secs"`
+	IdleTimeoutSecs     int    `mapstructure:"idle_timeout_secs"`
+	ShutdownTimeoutSecs int    `mapstructure:"shutdown_timeout_secs"`
+	TLSCert             string `mapstructure:"tls_cert"`
+	TLSKey              string `mapstructure:"tls_key"`
+	MaxSyncLagBlocks    int    `mapstructure:"max_sync_lag_blocks"`
+}
+
+type LogConfig struct {
+	Level  string `mapstructure:"level"`
+	Format string `mapstructure:"format"`
+}
+
+type RatesConfig struct {
+	Provider         string `mapstructure:"provider"`
+	File             string `mapstructure:"file"`
+	URL              string `mapstructure:"url"`
+	CacheSecs        int    `mapstructure:"cache_secs"`
+	MaxStalenessSecs int    `mapstructure:"max_staleness_secs"`
+}
+
+// Config is the whole application configuration, loaded once at startup
+// from ~/.mdp/app (or --config) with MDP_* environment overrides, e.g.
+// MDP_BUSINESS_N_ADS or MDP_DB_REDIS.
+type Config struct {
+	Server    ServerConfig    `mapstructure:"server"`
+	Log       LogConfig       `mapstructure:"log"`
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+	Business  BusinessConfig  `mapstructure:"business"`
+	Cookie    CookieConfig    `mapstructure:"cookie"`
+	Security  SecurityConfig  `mapstructure:"security"`
+	DB        DBConfig        `mapstructure:"db"`
+	Rates     RatesConfig     `mapstructure:"rates"`
+}
+
+// Every scalar setting needs a default for environment overrides to apply
+// when the key is missing from the config file.
+var configDefaults = map[string]interface{}{
+	"server.listen":                     ":8000",
+	"server.read_timeout_secs":          10,
+	"server.write_timeout_secs":         30,
+	"server.idle_timeout_secs":          120,
+	"server.shutdown_timeout_secs":      30,
+	"server.tls_cert":                   "",
+	"server.tls_key":                    "",
+	"server.max_sync_lag_blocks":        3,
+	"log.level":                         "info",
+	"log.format":                        "json",
+	"rate_limit.lock.per_minute":        30,
+	"rate_limit.lock.burst":             10,
+	"rate_limit.purchase.per_minute":    10,
+	"rate_limit.purchase.burst":         5,
+	"rate_limit.session.per_minute":     10,
+	"rate_limit.session.burst":          5,
+	"rate_limit.login.per_minute":       5,
+	"rate_limit.login.burst":            5,
+	"rate_limit.trust_proxy":            false,
+	"business.n_ads":                    0,
+	"business.ad_cost":                  0.0,
+	"business.ad_ttl_mins":              0,
+	"business.bank":                     "",
+	"business.address_type":             ADDRESS_TYPE_P2PKH,
+	"business.payment_mode":             PAYMENT_MODE_WALLET,
+	"business.payment_label":            "Million Dollar Page",
+	"business.xpub":                     "",
+	"business.invoice_ttl_mins":         60,
+	"business.renew_priority_mins":      10,
+	"business.lock_duration_mins":       5,
+	"business.max_lock_hold_mins":       30,
+	"business.max_locks_per_session":    3,
+	"business.currency":                 "",
+	"business.auction.window_mins":      60,
+	"business.booking.max_advance_days": 90,
+	"cookie.key1":                       "",
+	"cookie.key2":                       "",
+	"cookie.secure":                     false,
+	"security.seed_key":                 "",
+	"security.seed_key_file":            "",
+	"db.redis":                          "",
+	"db.pg":                             "",
+	"db.btcd.host":                      "",
+	"db.btcd.username":                  "",
+	"db.btcd.password":                  "",
+	"db.btcd.network":                   "",
+	"db.btcd.is_simnet":                 false,
+	"rates.provider":                    "",
+	"rates.file":                        "",
+	"rates.url":                         "",
+	"rates.cache_secs":                  60,
+	"rates.max_staleness_secs":          900,
+}
+
+// LoadConfig reads the configuration file at path, or app.* in ~/.mdp/ when
+// path is empty, applies environment overrides and validates the result.
+func LoadConfig(path string) (*Config, error) {
+	v := viper.New()
+	for key, value := range configDefaults {
+		v.SetDefault(key, value)
+	}
+	v.SetEnvPrefix("mdp")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	if path != "" {
+		v.SetConfigFile(path)
+	} else {
+		v.SetConfigName("app")
+		if usr, err := user.Current(); err == nil {
+			v.AddConfigPath(filepath.Join(usr.HomeDir, ".mdp/"))
+		}
+	}
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if err := v.Unmarshal(config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// NetworkName resolves the network, honouring db.btcd.is_simnet when no
+// network is set.
+func (c *Config) NetworkName() string {
+	return network.Name(c.DB.Btcd.Network, c.DB.Btcd.IsSimnet)
+}
+
+func (c *Config) NetworkParams() (*chaincfg.Params, error) {
+	return network.Params(c.NetworkName())
+}
+
+func (c *Config) AdDuration() time.Duration {
+	return time.Duration(c.Business.AdTTLMins) * time.Minute
+}
+
+func (c *Config) LockDuration() time.Duration {
+	return time.Duration(c.Business.LockDurationMins) * time.Minute
+}
+
+func (c *Config) Validate() error {
+	b := c.Business
+	if b.NAds <= 0 {
+		return errors.New("business.n_ads must be positive")
+	}
+	if b.AdCost <= 0 {
+		return errors.New("business.ad_cost must be positive")
+	}
+	if b.AdTTLMins <= 0 {
+		return errors.New("business.ad_ttl_mins must be positive")
+	}
+	if b.AddressType != ADDRESS_TYPE_P2PKH && b.AddressType != ADDRESS_TYPE_P2WPKH {
+		return fmt.Errorf("business.address_type %s is unknown", b.AddressType)
+	}
+	if b.PaymentMode != PAYMENT_MODE_WALLET && b.PaymentMode != PAYMENT_MODE_INVOICE {
+		return fmt.Errorf("business.payment_mode %s is unknown", b.PaymentMode)
+	}
+	if b.PaymentMode == PAYMENT_MODE_INVOICE && b.Xpub == "" {
+		return errors.New("business.xpub is required in invoice mode")
+	}
+	if b.PaymentMode == PAYMENT_MODE_INVOICE && b.InvoiceTTLMins <= 0 {
+		return errors.New("business.invoice_ttl_mins must be positive")
+	}
+	if b.RenewPriorityMins < 0 {
+		return errors.New("business.renew_priority_mins cannot be negative")
+	}
+	if b.LockDurationMins <= 0 {
+		return errors.New("business.lock_duration_mins must be positive")
+	}
+	if b.MaxLockHoldMins != 0 && b.MaxLockHoldMins < b.LockDurationMins {
+		return errors.New("business.max_lock_hold_mins cannot be shorter than a lock")
+	}
+	if b.MaxLocks < 0 {
+		return errors.New("business.max_locks_per_session cannot be negative")
+	}
+
+	params, err := c.NetworkParams()
+	if err != nil {
+		return err
+	}
+	bank, err := btcutil.DecodeAddress(b.Bank, params)
+	if err != nil {
+		return fmt.Errorf("business.bank is not a valid address: %s", err)
+	}
+	if !bank.IsForNet(params) {
+		return fmt.Errorf("business.bank is not a %s address", params.Name)
+	}
+
+	pairs := append([]CookieKeyPair{{Key1: c.Cookie.Key1, Key2: c.Cookie.Key2}}, c.Cookie.OldKeys...)
+	for i, pair := range pairs {
+		name := "cookie"
+		if i > 0 {
+			name = fmt.Sprintf("cookie.old_keys[%d]", i-1)
+		}
+		if l := len(pair.Key2); l != 32 && l != 64 {
+			return fmt.Errorf("%s.key2 (hash key) must be 32 or 64 bytes", name)
+		}
+		if l := len(pair.Key1); l != 16 && l != 24 && l != 32 {
+			return fmt.Errorf("%s.key1 (block key) must be 16, 24 or 32 bytes", name)
+		}
+	}
+
+	// Session seeds only exist in wallet mode
+	if b.PaymentMode == PAYMENT_MODE_WALLET && c.Security.SeedKey == "" && c.Security.SeedKeyFile == "" {
+		return errors.New("security.seed_key or security.seed_key_file is required")
+	}
+
+	if b.Currency != "" {
+		switch c.Rates.Provider {
+		case "file":
+			if c.Rates.File == "" {
+				return errors.New("rates.file is required for the file provider")
+			}
+		case "http":
+			if c.Rates.URL == "" {
+				return errors.New("rates.url is required for the http provider")
+			}
+		default:
+			return fmt.Errorf("rates.provider %s is unknown", c.Rates.Provider)
+		}
+	}
+
+	if c.DB.Redis == "" || c.DB.PG == "" || c.DB.Btcd.Host == "" {
+		return errors.New("db.redis, db.pg and db.btcd.host are required")
+	}
+
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("log.level %s is unknown", c.Log.Level)
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		return fmt.Errorf("log.format %s is unknown", c.Log.Format)
+	}
+
+	for name, limit := range map[string]RateLimit{
+		"lock":     c.RateLimit.Lock,
+		"purchase": c.RateLimit.Purchase,
+		"session":  c.RateLimit.Session,
+		"login":    c.RateLimit.Login,
+	} {
+		if limit.PerMinute < 0 {
+			return fmt.Errorf("rate_limit.%s.per_minute cannot be negative", name)
+		}
+		if limit.PerMinute > 0 && limit.Burst < 1 {
+			return fmt.Errorf("rate_limit.%s.burst must be at least 1", name)
+		}
+	}
+
+	if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+		return errors.New("server.tls_cert and server.tls_key must be set together")
+	}
+	if c.Server.ReadTimeoutSecs < 0 || c.Server.WriteTimeoutSecs < 0 || c.Server.IdleTimeoutSecs < 0 || c.Server.ShutdownTimeoutSecs < 0 {
+		return errors.New("server timeouts cannot be negative")
+	}
+	if c.Server.MaxSyncLagBlocks < 0 {
+		return errors.New("server.max_sync_lag_blocks cannot be negative")
+	}
+	return nil
+}
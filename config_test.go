@@ -0,0 +1,108 @@
+package main
+
+import "io/ioutil"
+import "os"
+import "strings"
+import "testing"
+
+func validConfig() *Config {
+	return &Config{
+		Business: BusinessConfig{
+			NAds:             10,
+			AdCost:           0.001,
+			AdTTLMins:        60,
+			LockDurationMins: 5,
+			Bank:             "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2",
+			AddressType:      ADDRESS_TYPE_P2PKH,
+			PaymentMode:      PAYMENT_MODE_WALLET,
+		},
+		Cookie: CookieConfig{
+			Key1: strings.Repeat("a", 32),
+			Key2: strings.Repeat("b", 64),
+		},
+		Security: SecurityConfig{SeedKey: strings.Repeat("c", 64)},
+		Log:      LogConfig{Level: "info", Format: "json"},
+		DB: DBConfig{
+			Redis: "localhost:6379",
+			PG:    "postgres://localhost/mdp",
+			Btcd:  BtcdConfig{Host: "localhost:8334"},
+		},
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	config := validConfig()
+	config.Business.NAds = 0
+	if config.Validate() == nil {
+		t.Error("zero n_ads accepted")
+	}
+
+	config = validConfig()
+	config.Business.Bank = "not an address"
+	if config.Validate() == nil {
+		t.Error("invalid bank accepted")
+	}
+
+	// Testnet address on mainnet
+	config = validConfig()
+	config.Business.Bank = "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn"
+	if config.Validate() == nil {
+		t.Error("bank for another network accepted")
+	}
+
+	config = validConfig()
+	config.Cookie.Key2 = "short"
+	if config.Validate() == nil {
+		t.Error("short cookie key accepted")
+	}
+}
+
+func TestLoadConfigEnvOverride(t *testing.T) {
+	file, err := ioutil.TempFile("", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`
+[business]
+n_ads = 10
+ad_cost = 0.001
+ad_ttl_mins = 60
+bank = "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"
+
+[cookie]
+key1 = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+key2 = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+[security]
+seed_key = "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"
+
+[db]
+redis = "localhost:6379"
+pg = "postgres://localhost/mdp"
+
+[db.btcd]
+host = "localhost:8334"
+`)
+	file.Close()
+	os.Rename(file.Name(), file.Name()+".toml")
+	defer os.Remove(file.Name() + ".toml")
+
+	os.Setenv("MDP_BUSINESS_N_ADS", "25")
+	defer os.Unsetenv("MDP_BUSINESS_N_ADS")
+
+	config, err := LoadConfig(file.Name() + ".toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Business.NAds != 25 {
+		t.Errorf("n_ads is %d, expected the environment override", config.Business.NAds)
+	}
+	if config.Business.RenewPriorityMins != 10 {
+		t.Errorf("renew_priority_mins default not applied")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import "net/http"
+import "github.com/gorilla/securecookie"
+import "github.com/satori/go.uuid"
+
+// CookieCodecs builds the session cookie codecs. The current key pair comes
+// first so it signs new cookies, older pairs only decode existing ones.
+func CookieCodecs(config CookieConfig) []securecookie.Codec {
+	pairs := [][]byte{[]byte(config.Key2), []byte(config.Key1)}
+	for _, old := range config.OldKeys {
+		pairs = append(pairs, []byte(old.Key2), []byte(old.Key1))
+	}
+	return securecookie.CodecsFromPairs(pairs...)
+}
+
+// CSRFKeys derives a CSRF key from the hash key of every cookie key pair,
+// the current one first.
+func CSRFKeys(config CookieConfig) [][]byte {
+	keys := [][]byte{NewCSRFKey([]byte(config.Key2))}
+	for _, old := range config.OldKeys {
+		keys = append(keys, NewCSRFKey([]byte(old.Key2)))
+	}
+	return keys
+}
+
+// decodeCookie decodes the value of cookie name into fields. stale is set
+// when the cookie was signed with an old key pair and should be reissued.
+func (s *Server) decodeCookie(name string, value string, fields *map[string]string) (bool, error) {
+	stale := false
+	err := s.cookies[0].Decode(name, value, fields)
+	if err != nil && len(s.cookies) > 1 {
+		err = securecookie.DecodeMulti(name, value, fields, s.cookies[1:]...)
+		stale = err == nil
+	}
+	return stale, err
+}
+
+// decodeSession reads the session of a uuid cookie.
+func (s *Server) decodeSession(value string) (uuid.UUID, bool, error) {
+	fields := make(map[string]string)
+	stale, err := s.decodeCookie("uuid", value, &fields)
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+
+	session, err := uuid.FromString(fields["uuid"])
+	return session, stale, err
+}
+
+// issueSession sets the uuid cookie of session, signed with the current key.
+func (s *Server) issueSession(w http.ResponseWriter, session uuid.UUID) error {
+	value := map[string]string{
+		"uuid": session.String(),
+	}
+	encoded, err := securecookie.EncodeMulti("uuid", value, s.cookies...)
+	if err != nil {
+		return err
+	}
+	s.setSessionCookie(w, "uuid", encoded, true)
+	return nil
+}
+
+// decodeLogin reads the token of an account cookie, stale like
+// decodeSession.
+func (s *Server) decodeLogin(value string) (string, bool, error) {
+	fields := make(map[string]string)
+	stale, err := s.decodeCookie("account", value, &fields)
+	if err != nil {
+		return "", false, err
+	}
+	return fields["token"], stale, nil
+}
+
+func (s *Server) issueLogin(w http.ResponseWriter, token string) error {
+	value := map[string]string{
+		"token": token,
+	}
+	encoded, err := securecookie.EncodeMulti("account", value, s.cookies...)
+	if err != nil {
+		return err
+	}
+	s.setSessionCookie(w, "account", encoded, true)
+	return nil
+}
+
+func (s *Server) clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   name,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// setSessionCookie sets a cookie with the attributes every session cookie
+// shares. The session cookie itself is HttpOnly, the CSRF one must be
+// readable by the page.
+func (s *Server) setSessionCookie(w http.ResponseWriter, name string, value string, httpOnly bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: httpOnly,
+		Secure:   s.config.Cookie.Secure || s.config.Server.TLSCert != "",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import "net/http"
+import "net/http/httptest"
+import "testing"
+import "github.com/gorilla/securecookie"
+import "github.com/jinzhu/gorm"
+import "github.com/satori/go.uuid"
+
+func TestCookieKeyRotation(t *testing.T) {
+	old := CookieConfig{
+		Key1: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		Key2: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+	}
+	session := uuid.NewV4()
+	encoded, err := securecookie.EncodeMulti("uuid", map[string]string{
+		"uuid": session.String(),
+	}, CookieCodecs(old)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := CookieConfig{
+		Key1:    "cccccccccccccccccccccccccccccccc",
+		Key2:    "dddddddddddddddddddddddddddddddd",
+		OldKeys: []CookieKeyPair{{Key1: old.Key1, Key2: old.Key2}},
+	}
+	s := &Server{cookies: CookieCodecs(rotated)}
+	decoded, stale, err := s.decodeSession(encoded)
+	if err != nil || !uuid.Equal(decoded, session) {
+		t.Fatal("cookie from before the rotation not decoded:", err)
+	}
+	if !stale {
+		t.Error("cookie signed with an old key not marked for reissue")
+	}
+
+	// Without the old pair the session is lost
+	s = &Server{cookies: CookieCodecs(CookieConfig{Key1: rotated.Key1, Key2: rotated.Key2})}
+	if _, _, err := s.decodeSession(encoded); err == nil {
+		t.Error("cookie decoded with unrelated keys")
+	}
+}
+
+func TestLoginCookieRotation(t *testing.T) {
+	if err := client.Ping().Err(); err != nil {
+		t.Skip("redis is not available:", err)
+	}
+	dbs, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := NewAccountManager(dbs, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := accounts.Register("rotation@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := accounts.Login(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := CookieConfig{
+		Key1: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		Key2: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+	}
+	encoded, err := securecookie.EncodeMulti("account", map[string]string{
+		"token": token,
+	}, CookieCodecs(old)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := CookieConfig{
+		Key1:    "cccccccccccccccccccccccccccccccc",
+		Key2:    "dddddddddddddddddddddddddddddddd",
+		OldKeys: []CookieKeyPair{{Key1: old.Key1, Key2: old.Key2}},
+	}
+	s := &Server{
+		config:   validConfig(),
+		cookies:  CookieCodecs(rotated),
+		csrfKeys: CSRFKeys(rotated),
+		accounts: accounts,
+	}
+	decoded, stale, err := s.decodeLogin(encoded)
+	if err != nil || decoded != token || !stale {
+		t.Fatalf("got %q, stale %v, %v for a login from before the rotation", decoded, stale, err)
+	}
+
+	session := uuid.NewV4()
+	if err := accounts.LinkWallet(account.ID, session); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/account", nil)
+	r.AddCookie(&http.Cookie{Name: "account", Value: encoded})
+	w := httptest.NewRecorder()
+	var accountId uint
+	s.AuthMiddleware(func(w http.ResponseWriter, r *http.Request, details *UserDetails) {
+		accountId = details.AccountId
+	})(w, r)
+	if accountId != account.ID {
+		t.Fatalf("got account %d, want %d", accountId, account.ID)
+	}
+
+	reissued := ""
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "account" {
+			reissued = cookie.Value
+		}
+	}
+	if reissued == "" {
+		t.Fatal("login signed with an old key not reissued")
+	}
+	decoded, stale, err = s.decodeLogin(reissued)
+	if err != nil || decoded != token || stale {
+		t.Errorf("got %q, stale %v, %v for the reissued login", decoded, stale, err)
+	}
+}
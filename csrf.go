@@ -0,0 +1,47 @@
+package main
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "crypto/subtle"
+import "encoding/base64"
+import "net/http"
+import "github.com/satori/go.uuid"
+
+// CSRF tokens are derived from the session, so they need no storage. The
+// token is handed to the page in a cookie only our origin can read and has
+// to come back in a header, which third party pages cannot set.
+const (
+	CSRF_COOKIE = "csrf_token"
+	CSRF_HEADER = "X-CSRF-Token"
+)
+
+// NewCSRFKey derives the token key from the cookie hash key.
+func NewCSRFKey(hashKey []byte) []byte {
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write([]byte("csrf"))
+	return mac.Sum(nil)
+}
+
+func CSRFToken(key []byte, session uuid.UUID) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(session.Bytes())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ValidCSRF checks the token sent with r against the ones of session. Keys
+// of rotated cookie pairs are accepted until the page picks up a new token.
+func ValidCSRF(keys [][]byte, r *http.Request, session uuid.UUID) bool {
+	token := r.Header.Get(CSRF_HEADER)
+	for _, key := range keys {
+		expected := CSRFToken(key, session)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSafeMethod reports whether a request cannot change state.
+func IsSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
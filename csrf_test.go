@@ -0,0 +1,32 @@
+package main
+
+import "net/http/httptest"
+import "testing"
+import "github.com/satori/go.uuid"
+
+func TestValidCSRF(t *testing.T) {
+	key := NewCSRFKey([]byte("0123456789abcdef0123456789abcdef"))
+	oldKey := NewCSRFKey([]byte("fedcba9876543210fedcba9876543210"))
+	keys := [][]byte{key, oldKey}
+	session := uuid.NewV4()
+
+	r := httptest.NewRequest("POST", "/purchase", nil)
+	if ValidCSRF(keys, r, session) {
+		t.Error("missing token accepted")
+	}
+
+	r.Header.Set(CSRF_HEADER, CSRFToken(key, uuid.NewV4()))
+	if ValidCSRF(keys, r, session) {
+		t.Error("token of another session accepted")
+	}
+
+	r.Header.Set(CSRF_HEADER, CSRFToken(key, session))
+	if !ValidCSRF(keys, r, session) {
+		t.Error("valid token rejected")
+	}
+
+	r.Header.Set(CSRF_HEADER, CSRFToken(oldKey, session))
+	if !ValidCSRF(keys, r, session) {
+		t.Error("token from before a key rotation rejected")
+	}
+}
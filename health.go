@@ -0,0 +1,135 @@
+package main
+
+import "errors"
+import "net/http"
+import "strconv"
+import "time"
+import "gopkg.in/redis.v4"
+
+const HEALTH_CHECK_TIMEOUT = time.Second * 2
+
+type ReadinessReport struct {
+	Status       string            `json:"status"`
+	Checks       map[string]string `json:"checks"`
+	SyncedHeight int64             `json:"synced_height"`
+	ChainHeight  int64             `json:"chain_height"`
+	SyncLag      int64             `json:"sync_lag"`
+}
+
+// HealthzHandler only tells the process is alive and serving.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, RequestLog(r), 200, map[string]string{
+		"status": "ok",
+	})
+}
+
+type checkResult struct {
+	height int64
+	err    error
+}
+
+// withTimeout runs check, giving up after HEALTH_CHECK_TIMEOUT so a hung
+// dependency fails readiness instead of hanging the probe.
+func withTimeout(check func() (int64, error)) (int64, error) {
+	done := make(chan checkResult, 1)
+	go func() {
+		height, err := check()
+		done <- checkResult{height, err}
+	}()
+	select {
+	case res := <-done:
+		return res.height, res.err
+	case <-time.After(HEALTH_CHECK_TIMEOUT):
+		return 0, errors.New("timed out")
+	}
+}
+
+// Readiness checks Redis, Postgres and btcd, and how far the addressmonitor
+// is behind the chain tip. Deposits are only credited once synced, so a
+// lagging monitor makes the server unable to take purchases.
+func (s *Server) Readiness() *ReadinessReport {
+	report := &ReadinessReport{
+		Status: "ok",
+		Checks: make(map[string]string),
+	}
+	fail := func(name string, err error) {
+		report.Status = "unavailable"
+		report.Checks[name] = err.Error()
+	}
+
+	if s.Draining() {
+		fail("server", errors.New("shutting down"))
+	}
+
+	var err error
+	report.SyncedHeight, err = withTimeout(func() (int64, error) {
+		start := time.Now()
+		err := s.redis.Ping().Err()
+		ObserveCall("redis", "ping", start, err)
+		if err != nil {
+			return 0, err
+		}
+
+		val, err := s.redis.Get("last_synced_block").Result()
+		if err == redis.Nil {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(val, 10, 64)
+	})
+	if err != nil {
+		fail("redis", err)
+	} else {
+		report.Checks["redis"] = "ok"
+	}
+
+	_, err = withTimeout(func() (int64, error) {
+		start := time.Now()
+		err := s.dbs.DB().Ping()
+		ObserveCall("postgres", "ping", start, err)
+		return 0, err
+	})
+	if err != nil {
+		fail("postgres", err)
+	} else {
+		report.Checks["postgres"] = "ok"
+	}
+
+	report.ChainHeight, err = withTimeout(func() (int64, error) {
+		start := time.Now()
+		height, err := s.rpc.GetBlockCount()
+		ObserveCall("rpc", "getblockcount", start, err)
+		return height, err
+	})
+	if err != nil {
+		fail("btcd", err)
+	} else {
+		report.Checks["btcd"] = "ok"
+	}
+
+	if report.Checks["redis"] == "ok" && report.Checks["btcd"] == "ok" {
+		report.SyncLag = report.ChainHeight - report.SyncedHeight
+		maxLag := int64(s.config.Server.MaxSyncLagBlocks)
+		if report.SyncLag > maxLag {
+			fail("addressmonitor", errors.New(
+				"sync lag of "+strconv.FormatInt(report.SyncLag, 10)+
+					" blocks exceeds "+strconv.FormatInt(maxLag, 10),
+			))
+		} else {
+			report.Checks["addressmonitor"] = "ok"
+		}
+	}
+	return report
+}
+
+// ReadyzHandler answers 503 whenever the server cannot take purchases.
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := s.Readiness()
+	status := 200
+	if report.Status != "ok" {
+		status = 503
+		RequestLog(r).WithField("checks", report.Checks).Warnln("Not ready")
+	}
+	WriteJSON(w, RequestLog(r), status, report)
+}
@@ -0,0 +1,322 @@
+package main
+
+import "errors"
+import "strconv"
+import "time"
+import "gopkg.in/redis.v4"
+import "github.com/satori/go.uuid"
+import "github.com/jinzhu/gorm"
+import "github.com/btcsuite/btcd/chaincfg"
+import "github.com/btcsuite/btcutil/hdkeychain"
+
+const (
+	PAYMENT_MODE_WALLET  = "wallet"
+	PAYMENT_MODE_INVOICE = "invoice"
+)
+
+const (
+	INVOICE_PENDING      = "PENDING"
+	INVOICE_PAID         = "PAID"
+	INVOICE_PAID_EXPIRED = "PAID_AFTER_EXPIRY"
+	INVOICE_EXPIRED      = "EXPIRED"
+)
+
+type Invoice struct {
+	Address   string    `json:"address"`
+	Tile      int       `json:"frame_number"`
+	Amount    float64   `json:"amount"`
+	Received  float64   `json:"received"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expires_at"`
+	SessionId uuid.UUID `json:"-"`
+	Message   string    `json:"-"`
+	Index     int64     `json:"-"`
+}
+
+// InvoiceManager issues per-lock invoice addresses derived from the receive
+// chain (xpub/0/i) of an operator xpub, so the operator wallet sees them.
+// The server never holds private keys in this mode: funds go straight to
+// the operator wallet and the tile is purchased once the invoice is paid.
+// Indexes of invoices that expire without a payment are handed out again
+// to stay within the wallet gap limit.
+type InvoiceManager struct {
+	receive     *hdkeychain.ExtendedKey
+	client      *redis.Client
+	dbs         *gorm.DB
+	tiles       *TileManager
+	params      *chaincfg.Params
+	addressType string
+	invoiceLife time.Duration
+	adDuration  time.Duration
+}
+
+func NewInvoiceManager(xpub string, client *redis.Client, dbs *gorm.DB, tiles *TileManager, params *chaincfg.Params, addressType string, invoiceLife time.Duration, adDuration time.Duration) (*InvoiceManager, error) {
+	key, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		return nil, err
+	}
+	if key.IsPrivate() {
+		return nil, errors.New("Invoice mode requires an xpub, not a private key")
+	}
+	if !key.IsForNet(params) {
+		return nil, errors.New("The xpub is not for the configured network")
+	}
+	receive, err := key.Child(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &InvoiceManager{
+		receive:     receive,
+		client:      client,
+		dbs:         dbs,
+		tiles:       tiles,
+		params:      params,
+		addressType: addressType,
+		invoiceLife: invoiceLife,
+		adDuration:  adDuration,
+	}, nil
+}
+
+func (im *InvoiceManager) keyForInvoice(address string) string {
+	return "invoice:" + address
+}
+
+func (im *InvoiceManager) keyForTileInvoice(tile int, session uuid.UUID) string {
+	return "tile_invoice:" + strconv.Itoa(tile) + ":" + session.String()
+}
+
+// NewInvoice returns the pending invoice for a tile locked by the session,
+// creating one at a free receive index when needed. The tile lock is
+// extended to the invoice lifetime so payment can confirm.
+func (im *InvoiceManager) NewInvoice(tile int, session uuid.UUID, message string, amount float64) (*Invoice, error) {
+	if err := ValidateMessage(message); err != nil {
+		return nil, err
+	}
+
+	tileKey := im.keyForTileInvoice(tile, session)
+	if address, err := im.client.Get(tileKey).Result(); err == nil {
+		invoice, err := im.Get(address)
+		if err == nil && invoice.pendingFor(tile, session) {
+			return invoice, nil
+		}
+	}
+
+	index, err := im.nextIndex()
+	if err != nil {
+		return nil, err
+	}
+	child, err := im.receive.Child(uint32(index))
+	if err != nil {
+		return nil, err
+	}
+	addr, err := DeriveAddress(child, im.addressType, im.params)
+	if err != nil {
+		return nil, err
+	}
+
+	invoice := &Invoice{
+		Address:   addr.EncodeAddress(),
+		Tile:      tile,
+		Amount:    amount,
+		Status:    INVOICE_PENDING,
+		ExpiresAt: time.Now().Add(im.invoiceLife),
+		SessionId: session,
+		Message:   message,
+		Index:     index,
+	}
+
+	// Let the addressmonitor pick up payments to this address
+	if err := im.client.SAdd("known_addresses", invoice.Address).Err(); err != nil {
+		return nil, err
+	}
+	if err := im.save(invoice); err != nil {
+		return nil, err
+	}
+	if err := im.client.Set(tileKey, invoice.Address, im.invoiceLife).Err(); err != nil {
+		return nil, err
+	}
+	if err := im.client.SAdd("pending_invoices", invoice.Address).Err(); err != nil {
+		return nil, err
+	}
+	if err := im.tiles.ExtendLock(tile, im.invoiceLife, session); err != nil {
+		return nil, err
+	}
+	Log.Infof("Created invoice %s for tile %d", invoice.Address, tile)
+	return invoice, nil
+}
+
+// nextIndex returns an index freed by an unpaid invoice, or the next unused
+// one.
+func (im *InvoiceManager) nextIndex() (int64, error) {
+	free, err := im.client.SPop("free_invoice_indexes").Result()
+	if err == nil {
+		return strconv.ParseInt(free, 10, 64)
+	} else if err != redis.Nil {
+		return 0, err
+	}
+
+	index, err := im.client.Incr("invoice_index").Result()
+	return index - 1, err
+}
+
+// pendingFor reports whether the invoice is still unpaid and belongs to the
+// lock of session on tile. Addresses are reused, an old pointer to one may
+// now lead to somebody else's invoice.
+func (invoice *Invoice) pendingFor(tile int, session uuid.UUID) bool {
+	return invoice.Status == INVOICE_PENDING && invoice.Tile == tile && uuid.Equal(invoice.SessionId, session)
+}
+
+// Pending reports whether the session has an unpaid invoice for a tile.
+func (im *InvoiceManager) Pending(tile int, session uuid.UUID) bool {
+	address, err := im.client.Get(im.keyForTileInvoice(tile, session)).Result()
+	if err != nil {
+		return false
+	}
+	invoice, err := im.Get(address)
+	return err == nil && invoice.pendingFor(tile, session)
+}
+
+func (im *InvoiceManager) save(invoice *Invoice) error {
+	key := im.keyForInvoice(invoice.Address)
+	err := im.client.HMSet(key, map[string]string{
+		"tile":       strconv.Itoa(invoice.Tile),
+		"amount":     strconv.FormatFloat(invoice.Amount, 'f', 8, 64),
+		"status":     invoice.Status,
+		"expires_at": strconv.FormatInt(invoice.ExpiresAt.Unix(), 10),
+		"session":    invoice.SessionId.String(),
+		"message":    invoice.Message,
+		"index":      strconv.FormatInt(invoice.Index, 10),
+	}).Err()
+	if err != nil {
+		return err
+	}
+	return im.client.Expire(key, SESSION_LIFE).Err()
+}
+
+func (im *InvoiceManager) Get(address string) (*Invoice, error) {
+	fields, err := im.client.HGetAll(im.keyForInvoice(address)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("Invoice not found")
+	}
+
+	invoice := &Invoice{
+		Address: address,
+		Status:  fields["status"],
+		Message: fields["message"],
+		Index:   -1,
+	}
+	if index, err := strconv.ParseInt(fields["index"], 10, 64); err == nil {
+		invoice.Index = index
+	}
+	if invoice.Tile, err = strconv.Atoi(fields["tile"]); err != nil {
+		return nil, err
+	}
+	if invoice.Amount, err = strconv.ParseFloat(fields["amount"], 64); err != nil {
+		return nil, err
+	}
+	expiresAt, err := strconv.ParseInt(fields["expires_at"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	invoice.ExpiresAt = time.Unix(expiresAt, 0)
+	if invoice.SessionId, err = uuid.FromString(fields["session"]); err != nil {
+		return nil, err
+	}
+	if invoice.Received, err = im.Received(address); err != nil {
+		return nil, err
+	}
+	return invoice, nil
+}
+
+// Received sums every output the addressmonitor has seen for the address,
+// spent or not, as the operator may sweep the funds at any time.
+func (im *InvoiceManager) Received(address string) (float64, error) {
+	var total float64
+	start := time.Now()
+	err := im.dbs.Table("transactions").Select(
+		"COALESCE(SUM(amount), 0)",
+	).Where("address = ?", address).Row().Scan(&total)
+	ObserveCall("postgres", "received", start, err)
+	return total, err
+}
+
+// Settle purchases the tiles of every pending invoice paid in full and
+// expires unpaid ones.
+func (im *InvoiceManager) Settle() error {
+	addresses, err := im.client.SMembers("pending_invoices").Result()
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		invoice, err := im.Get(address)
+		if err != nil {
+			Log.Errorln("Unable to load invoice", address, err)
+			continue
+		}
+
+		paid := invoice.Received >= invoice.Amount
+		if !paid && !time.Now().After(invoice.ExpiresAt) {
+			continue
+		}
+
+		// Several servers may settle at once, only the one whose SREM
+		// removed the invoice gets to purchase the tile
+		claimed, err := im.client.SRem("pending_invoices", address).Result()
+		if err != nil {
+			return err
+		}
+		if claimed == 0 {
+			continue
+		}
+
+		if paid {
+			invoice.Status = im.purchase(invoice)
+		} else {
+			invoice.Status = INVOICE_EXPIRED
+		}
+		if err := im.save(invoice); err != nil {
+			return err
+		}
+
+		// Nothing was ever sent there, the next invoice can have the index
+		if !paid && invoice.Received == 0 && invoice.Index >= 0 {
+			if err := im.client.SAdd("free_invoice_indexes", strconv.FormatInt(invoice.Index, 10)).Err(); err != nil {
+				return err
+			}
+		}
+		Log.Infof("Invoice %s for tile %d is %s", address, invoice.Tile, invoice.Status)
+	}
+	return nil
+}
+
+func (im *InvoiceManager) purchase(invoice *Invoice) string {
+	im.tiles.PurchaseLock.Lock()
+	defer im.tiles.PurchaseLock.Unlock()
+
+	// Paid too late, somebody else may own the tile now. Kept for refunds.
+	canPurchase, _ := im.tiles.CanPurchase(invoice.Tile, invoice.SessionId)
+	if !canPurchase {
+		return INVOICE_PAID_EXPIRED
+	}
+
+	err := im.tiles.PurchaseTile(
+		invoice.Tile, invoice.Message, im.adDuration,
+		invoice.SessionId, invoice.Address,
+	)
+	if err != nil {
+		Log.Errorln("Unable to purchase tile for invoice", invoice.Address, err)
+		return INVOICE_PAID_EXPIRED
+	}
+	RecordPurchase(PAYMENT_MODE_INVOICE, invoice.Received)
+	return INVOICE_PAID
+}
+
+// Watch settles invoices periodically, forever.
+func (im *InvoiceManager) Watch(interval time.Duration) {
+	runEvery(interval, im.Settle)
+}
@@ -0,0 +1,212 @@
+package main
+
+import "testing"
+import "time"
+import "github.com/btcsuite/btcd/chaincfg"
+import "github.com/btcsuite/btcutil/hdkeychain"
+import "github.com/jinzhu/gorm"
+import "github.com/satori/go.uuid"
+import _ "github.com/jinzhu/gorm/dialects/sqlite"
+
+// newTestInvoiceManager uses the redis of key_manager_test.go and an in
+// memory transactions table standing in for the addressmonitor.
+func newTestInvoiceManager(t *testing.T, tiles ...int) *InvoiceManager {
+	if err := client.Ping().Err(); err != nil {
+		t.Skip("redis is not available:", err)
+	}
+
+	dbs, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dbs.Exec("CREATE TABLE transactions (address TEXT, amount REAL, spent BOOLEAN)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	seed := make([]byte, hdkeychain.RecommendedSeedLen)
+	master, err := hdkeychain.NewMaster(seed, &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpub, err := master.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invoices left pending by earlier runs would be settled by these tests
+	client.Del("pending_invoices", "free_invoice_indexes")
+
+	tm := NewTileManager(1000, client, 0, 0, 0)
+	for _, tile := range tiles {
+		client.Del(tm.keyForTile(tile), tm.keyForQuote(tile), tm.keyForOwner(tile), tm.KeyForBody(tile))
+	}
+	im, err := NewInvoiceManager(xpub.String(), client, dbs, tm, &chaincfg.TestNet3Params, ADDRESS_TYPE_P2PKH, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return im
+}
+
+func lockForInvoice(t *testing.T, im *InvoiceManager, tile int, session uuid.UUID) *Invoice {
+	err, state := im.tiles.Lock(tile, time.Minute, session, &PriceQuote{Price: 0.001})
+	if err != nil || state != STATE_LOCKED_BY_CURRENT_USER {
+		t.Fatalf("unable to lock tile %d: %v %s", tile, err, state)
+	}
+	invoice, err := im.NewInvoice(tile, session, "hello", 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return invoice
+}
+
+func pay(t *testing.T, im *InvoiceManager, address string, amount float64) {
+	err := im.dbs.Exec("INSERT INTO transactions (address, amount, spent) VALUES (?, ?, ?)", address, amount, false).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewInvoiceReusesPending(t *testing.T) {
+	im := newTestInvoiceManager(t, 900)
+	session := uuid.NewV4()
+
+	invoice := lockForInvoice(t, im, 900, session)
+	again, err := im.NewInvoice(900, session, "hello", 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Address != invoice.Address {
+		t.Errorf("got a second invoice %s for pending %s", again.Address, invoice.Address)
+	}
+	if !im.Pending(900, session) {
+		t.Error("invoice is not pending")
+	}
+
+	invoice.Status = INVOICE_EXPIRED
+	if err := im.save(invoice); err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := im.NewInvoice(900, session, "hello", 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh.Address == invoice.Address {
+		t.Error("expired invoice was reused")
+	}
+}
+
+func TestInvoiceIndexReuse(t *testing.T) {
+	im := newTestInvoiceManager(t, 905, 906)
+
+	abandoned := lockForInvoice(t, im, 905, uuid.NewV4())
+	child, err := im.receive.Child(uint32(abandoned.Index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := DeriveAddress(child, ADDRESS_TYPE_P2PKH, im.params)
+	if addr.EncodeAddress() != abandoned.Address {
+		t.Error("invoice not derived on the receive chain")
+	}
+
+	abandoned.ExpiresAt = time.Now().Add(-time.Second)
+	if err := im.save(abandoned); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Settle(); err != nil {
+		t.Fatal(err)
+	}
+
+	session := uuid.NewV4()
+	next := lockForInvoice(t, im, 906, session)
+	if next.Index != abandoned.Index || next.Address != abandoned.Address {
+		t.Errorf("got index %d, want the unpaid %d back", next.Index, abandoned.Index)
+	}
+	if !im.Pending(906, session) {
+		t.Error("invoice on a reused address is not pending")
+	}
+	if im.Pending(905, abandoned.SessionId) {
+		t.Error("previous invoice on the address still pending")
+	}
+}
+
+func TestNewInvoiceRejectsEmptyMessage(t *testing.T) {
+	im := &InvoiceManager{}
+	if _, err := im.NewInvoice(0, uuid.NewV4(), "", 0.001); err == nil {
+		t.Error("empty message accepted")
+	}
+}
+
+func TestInvoiceReceived(t *testing.T) {
+	im := newTestInvoiceManager(t)
+
+	pay(t, im, "addr1", 0.25)
+	pay(t, im, "addr1", 0.5)
+	pay(t, im, "addr2", 1)
+	if err := im.dbs.Exec("UPDATE transactions SET spent = ? WHERE amount = ?", true, 0.5).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := im.Received("addr1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != 0.75 {
+		t.Errorf("got %v received, want spent outputs counted too", received)
+	}
+	if received, _ := im.Received("unknown"); received != 0 {
+		t.Errorf("got %v received on an unused address", received)
+	}
+}
+
+func TestInvoiceSettle(t *testing.T) {
+	im := newTestInvoiceManager(t, 901, 902, 903, 904)
+
+	paid := lockForInvoice(t, im, 901, uuid.NewV4())
+	pay(t, im, paid.Address, 0.001)
+
+	// The lock went to somebody else before the payment arrived
+	late := lockForInvoice(t, im, 902, uuid.NewV4())
+	pay(t, im, late.Address, 0.001)
+	im.tiles.Client.Set(im.tiles.keyForTile(902), uuid.NewV4().String(), time.Minute)
+
+	expired := lockForInvoice(t, im, 903, uuid.NewV4())
+	pay(t, im, expired.Address, 0.0005)
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	if err := im.save(expired); err != nil {
+		t.Fatal(err)
+	}
+
+	underpaid := lockForInvoice(t, im, 904, uuid.NewV4())
+	pay(t, im, underpaid.Address, 0.0005)
+
+	if err := im.Settle(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		paid.Address:      INVOICE_PAID,
+		late.Address:      INVOICE_PAID_EXPIRED,
+		expired.Address:   INVOICE_EXPIRED,
+		underpaid.Address: INVOICE_PENDING,
+	}
+	for address, status := range expected {
+		invoice, err := im.Get(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if invoice.Status != status {
+			t.Errorf("invoice for tile %d is %s, want %s", invoice.Tile, invoice.Status, status)
+		}
+		pending, _ := im.client.SIsMember("pending_invoices", address).Result()
+		if pending != (status == INVOICE_PENDING) {
+			t.Errorf("invoice for tile %d pending is %v", invoice.Tile, pending)
+		}
+	}
+
+	if owner, err := im.tiles.Owner(901); err != nil || owner.PurchaseId != paid.Address {
+		t.Errorf("tile 901 was not purchased: %v %v", owner, err)
+	}
+	if owner, _ := im.tiles.Owner(902); owner != nil && owner.PurchaseId == late.Address {
+		t.Error("tile 902 was purchased after the lock was lost")
+	}
+}
@@ -4,10 +4,8 @@ import "fmt"
 import "io"
 import "errors"
 import "io/ioutil"
-import "strings"
 import "bytes"
 import "time"
-import "encoding/hex"
 import "gopkg.in/redis.v4"
 import "github.com/satori/go.uuid"
 import "github.com/btcsuite/btcutil/hdkeychain"
@@ -18,25 +16,57 @@ import "github.com/btcsuite/btcd/txscript"
 import "github.com/btcsuite/btcd/chaincfg/chainhash"
 import "github.com/btcsuite/btcutil"
 import "github.com/jinzhu/gorm"
+import "github.com/sirupsen/logrus"
 import "github.com/btcsuite/btcd/btcec"
 import _ "github.com/jinzhu/gorm/dialects/postgres"
 
 const SESSION_LIFE = time.Hour * 24 * 30
 
+// Pushes back the expiry of a session seed to ARGV[1] seconds, unless the
+// wallet is linked to an account: those seeds never expire. KEYS are the
+// seed and its linked marker.
+var renewSeedScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return redis.call('PERSIST', KEYS[1])
+end
+return redis.call('EXPIRE', KEYS[1], ARGV[1])
+`)
+
+func keyForSeed(session uuid.UUID) string {
+	return "session:" + session.String()
+}
+
+func keyForLinkedSeed(session uuid.UUID) string {
+	return "linked_seed:" + session.String()
+}
+
+const (
+	ADDRESS_TYPE_P2PKH  = "p2pkh"
+	ADDRESS_TYPE_P2WPKH = "p2wpkh"
+)
+
+// ADDRESS_TYPES lists every address type a deployment may have used. A tile
+// has the same key whatever the type, only its address differs.
+var ADDRESS_TYPES = []string{ADDRESS_TYPE_P2PKH, ADDRESS_TYPE_P2WPKH}
+
 type AddressGenerator interface {
-	PerformPurchase(address btcutil.Address, amount float64, dstAddress btcutil.Address) string
+	PerformPurchase(address btcutil.Address, amount float64, dstAddress btcutil.Address) (string, error)
 	MakeAddresses(num int) []string
 	GetAddressBalances(num int) []float64
 	GetBalanceForAddress(address string) float64
 }
 
 type KeyManager struct {
-	dbs        *gorm.DB
-	client     *redis.Client
-	rpc        *btcrpcclient.Client
-	identifier uuid.UUID
-	addressMap map[string]*btcec.PrivateKey
-	params     *chaincfg.Params
+	dbs         *gorm.DB
+	client      *redis.Client
+	rpc         *btcrpcclient.Client
+	identifier  uuid.UUID
+	addressMap  map[string]*btcec.PrivateKey
+	previous    map[string][]string
+	params      *chaincfg.Params
+	addressType string
+	seeds       *SeedCipher
+	log         *logrus.Entry
 }
 
 func (k *KeyManager) GetAddressBalances(num int) []float64 {
@@ -49,7 +79,7 @@ func (k *KeyManager) GetAddressBalances(num int) []float64 {
 }
 
 func (k *KeyManager) GetBalanceForAddress(address string) float64 {
-	_, total := k.Unspent(address, -1.0)
+	_, total := k.Unspent(k.addresses(address), -1.0)
 	return total
 }
 
@@ -62,16 +92,58 @@ func (k *KeyManager) MakeAddresses(num int) []string {
 	pkeys := make([]string, num)
 	for i := 0; i < num; i++ {
 		acct, _ := chain.Child(uint32(i))
-		addr, _ := acct.Address(k.params)
+		addr, err := DeriveAddress(acct, k.addressType, k.params)
+		if err != nil {
+			panic(err)
+		}
 		pkeys[i] = addr.EncodeAddress()
 		privKey, _ := acct.ECPrivKey()
 		k.addressMap[pkeys[i]] = privKey
 		k.client.SAdd("known_addresses", pkeys[i])
-		Info.Printf("Made address %s for user %s\n", pkeys[i], k.identifier)
+		k.log.Debugf("Made address %s", pkeys[i])
+
+		// Deposits sent before business.address_type changed stay
+		// visible and spendable
+		var previous []string
+		for _, addressType := range ADDRESS_TYPES {
+			if addressType == k.addressType {
+				continue
+			}
+			addr, err := DeriveAddress(acct, addressType, k.params)
+			if err != nil {
+				panic(err)
+			}
+			previous = append(previous, addr.EncodeAddress())
+			k.addressMap[addr.EncodeAddress()] = privKey
+			k.client.SAdd("known_addresses", addr.EncodeAddress())
+		}
+		k.previous[pkeys[i]] = previous
 	}
 	return pkeys
 }
 
+// addresses returns address along with the addresses of the same key under
+// the other address types.
+func (k *KeyManager) addresses(address string) []string {
+	return append([]string{address}, k.previous[address]...)
+}
+
+// DeriveAddress derives the deposit address for a child key, using either a
+// legacy P2PKH or a native SegWit P2WPKH address depending on the deployment.
+// It works for both private and public (xpub) keys.
+func DeriveAddress(acct *hdkeychain.ExtendedKey, addressType string, params *chaincfg.Params) (btcutil.Address, error) {
+	if addressType != ADDRESS_TYPE_P2WPKH {
+		return acct.Address(params)
+	}
+
+	pubKey, err := acct.ECPubKey()
+	if err != nil {
+		return nil, err
+	}
+	pkHash := btcutil.Hash160(pubKey.SerializeCompressed())
+	return btcutil.NewAddressWitnessPubKeyHash(pkHash, params)
+}
+
 func (k *KeyManager) GetChain() (*hdkeychain.ExtendedKey, error) {
 	masterKeyByteSlice, err := ioutil.ReadAll(k.GetMasterKey())
 	if err != nil {
@@ -86,37 +158,61 @@ func (k *KeyManager) GetChain() (*hdkeychain.ExtendedKey, error) {
 }
 
 func (k *KeyManager) GetMasterKey() io.Reader {
-	identifierKey := "session:" + k.identifier.String()
+	identifierKey := keyForSeed(k.identifier)
+	start := time.Now()
 	val, err := k.client.Get(identifierKey).Result()
+	ObserveCall("redis", "session", start, err)
 	if err != nil && err != redis.Nil {
 		panic(err)
 	}
 
 	// If value not present, create key. Else, renew
 	if err == redis.Nil {
-		Info.Printf("Session not found for user %s. generating a new one", k.identifier.String())
+		k.log.Infoln("Session not found, generating a new one")
 		newSeed, err := hdkeychain.GenerateSeed(hdkeychain.RecommendedSeedLen)
 		if err != nil {
 			panic(err)
 		}
-		k.client.SetNX(identifierKey, newSeed, SESSION_LIFE).Result()
+		encryptedSeed, err := k.seeds.Encrypt(newSeed, identifierKey)
+		if err != nil {
+			panic(err)
+		}
+		k.client.SetNX(identifierKey, encryptedSeed, SESSION_LIFE).Result()
+		k.renewSeed()
 		return bytes.NewReader(newSeed)
 	} else {
-		Info.Printf("Session found for user %s. renewing", k.identifier.String())
-		k.client.Expire(identifierKey, SESSION_LIFE)
-		return strings.NewReader(val)
+		k.log.Debugln("Session found, renewing")
+		seed, _, err := k.seeds.Decrypt([]byte(val), identifierKey)
+		if err != nil {
+			panic(err)
+		}
+		k.renewSeed()
+		return bytes.NewReader(seed)
 	}
 }
 
-func (k *KeyManager) Unspent(address string, amount float64) ([]*wire.OutPoint, float64) {
+func (k *KeyManager) renewSeed() {
+	err := renewSeedScript.Run(
+		k.client,
+		[]string{keyForSeed(k.identifier), keyForLinkedSeed(k.identifier)},
+		int64(SESSION_LIFE/time.Second),
+	).Err()
+	if err != nil {
+		k.log.Errorln("Unable to renew session seed:", err)
+	}
+}
+
+func (k *KeyManager) Unspent(addresses []string, amount float64) ([]*wire.OutPoint, float64) {
+	start := time.Now()
 	rows, err := k.dbs.Table("transactions").Select(
 		"transaction_id, idx, amount",
 	).Where(
-		"address = ? AND spent = ?",
-		address, false,
+		"address IN (?) AND spent = ?",
+		addresses, false,
 	).Rows()
+	ObserveCall("postgres", "unspent", start, err)
 	if err != nil {
-		Error.Fatal(err)
+		k.log.Panic(err)
 	}
 	defer rows.Close()
 
@@ -131,13 +227,13 @@ func (k *KeyManager) Unspent(address string, amount float64) ([]*wire.OutPoint,
 		// If transaction is in the mempool (spent) ignore.
 		key := fmt.Sprintf("spent_tx_in_mempool:%s:%d", transactionId, idx)
 		if res, _ := k.client.Exists(key).Result(); res == true {
-			Info.Printf("Transaction %s ID already spent (in mempool). Ignoring..\n", transactionId)
+			k.log.Debugf("Transaction %s already spent in mempool, ignoring", transactionId)
 			continue
 		}
 
 		txHash, err := chainhash.NewHashFromStr(transactionId)
 		if err != nil {
-			Error.Fatal(err)
+			k.log.Panic(err)
 		}
 		op := wire.NewOutPoint(
 			txHash, uint32(idx),
@@ -148,10 +244,10 @@ func (k *KeyManager) Unspent(address string, amount float64) ([]*wire.OutPoint,
 	return outPoints, res
 }
 
-func (k *KeyManager) PerformPurchase(address btcutil.Address, amount float64, dstAddress btcutil.Address) string {
+func (k *KeyManager) PerformPurchase(address btcutil.Address, amount float64, dstAddress btcutil.Address) (string, error) {
 	// Get all unspent transactions fot amount
 
-	inputs, totalSpent := k.Unspent(address.String(), amount)
+	inputs, totalSpent := k.Unspent(k.addresses(address.String()), amount)
 	totalSpent *= 100000000
 	amount *= 100000000
 
@@ -159,22 +255,20 @@ func (k *KeyManager) PerformPurchase(address btcutil.Address, amount float64, ds
 	amountInt := int64(amount)
 
 	// Create TXins
-	tx := wire.NewMsgTx()
+	tx := wire.NewMsgTx(wire.TxVersion)
 	for _, input := range inputs {
-		txIn := wire.NewTxIn(input, nil)
+		txIn := wire.NewTxIn(input, nil, nil)
 		tx.AddTxIn(txIn)
 	}
 
 	// Create pay-to-addr script
 	pkScript, err := txscript.PayToAddrScript(dstAddress)
 	if err != nil {
-		Error.Fatal(err)
+		return "", err
 	}
 
 	// Add transactions
-	Info.Println(amountInt)
 	amountInt -= int64(0.0001 * 100000000 * 5)
-	Info.Println(amountInt)
 	txOut := wire.NewTxOut(amountInt, pkScript)
 	tx.AddTxOut(txOut)
 
@@ -182,52 +276,69 @@ func (k *KeyManager) PerformPurchase(address btcutil.Address, amount float64, ds
 	if delta > 0 {
 		changePkScript, err := txscript.PayToAddrScript(address)
 		if err != nil {
-			Error.Fatal(err)
+			return "", err
 		}
 		changeTxOut := wire.NewTxOut(delta, changePkScript)
 		tx.AddTxOut(changeTxOut)
 	}
 
 	// Sign inputs
+	sigHashes := txscript.NewTxSigHashes(tx)
 	for idx, txin := range tx.TxIn {
 		hash := txin.PreviousOutPoint.Hash
 		prevTxIdx := int(txin.PreviousOutPoint.Index)
+		start := time.Now()
 		prevTx, err := k.rpc.GetRawTransaction(&hash)
+		ObserveCall("rpc", "getrawtransaction", start, err)
 		if err != nil {
-			Error.Panic(err)
+			return "", err
+		}
+		prevOut := prevTx.MsgTx().TxOut[prevTxIdx]
+
+		// Native SegWit outputs are signed through the witness, leaving
+		// the signature script empty.
+		if txscript.IsPayToWitnessPubKeyHash(prevOut.PkScript) {
+			privKey, _, err := k.GetKey(address)
+			if err != nil {
+				return "", err
+			}
+			witness, err := txscript.WitnessSignature(
+				tx, sigHashes, idx, prevOut.Value, prevOut.PkScript,
+				txscript.SigHashAll, privKey, true,
+			)
+			if err != nil {
+				return "", err
+			}
+			txin.Witness = witness
+			continue
 		}
 
 		sigScript, err := txscript.SignTxOutput(
 			k.params, tx, idx,
-			prevTx.MsgTx().TxOut[prevTxIdx].PkScript,
+			prevOut.PkScript,
 			txscript.SigHashAll, k, nil, nil,
 		)
-		Info.Println(string(sigScript))
 		if err != nil {
-			Error.Panic(err)
+			return "", err
 		}
 		txin.SignatureScript = sigScript
 	}
 
-	// Serialize
-	datas := make([]byte, 0, tx.SerializeSize())
-	buffer := bytes.NewBuffer(datas)
-	tx.Serialize(buffer)
-
-	Info.Println(hex.EncodeToString(buffer.Bytes()))
-
 	// Send transaction
+	start := time.Now()
 	hash, err := k.rpc.SendRawTransaction(tx, true)
+	ObserveCall("rpc", "sendrawtransaction", start, err)
 	if err != nil {
-		Error.Fatal(err)
+		return "", err
 	}
+	k.log.Infof("Sent TX %s for %d satoshis", hash, amountInt)
 
 	// We are successful, add spent transactions to seen set to avoid double spend
-	return hash.String()
+	return hash.String(), nil
 }
 
 func (k *KeyManager) GetKey(address btcutil.Address) (*btcec.PrivateKey, bool, error) {
-	Info.Printf("Finding private key for address %s\n", address.String())
+	k.log.Debugf("Finding private key for address %s", address.String())
 	if pk := k.addressMap[address.String()]; pk != nil {
 		return pk, true, nil
 	}
@@ -235,13 +346,17 @@ func (k *KeyManager) GetKey(address btcutil.Address) (*btcec.PrivateKey, bool, e
 	return nil, false, errors.New("Could not find key")
 }
 
-func NewKeyManager(client *redis.Client, identifier uuid.UUID, dbs *gorm.DB, rpc *btcrpcclient.Client, params *chaincfg.Params) *KeyManager {
+func NewKeyManager(client *redis.Client, identifier uuid.UUID, dbs *gorm.DB, rpc *btcrpcclient.Client, params *chaincfg.Params, addressType string, seeds *SeedCipher, log *logrus.Entry) *KeyManager {
 	return &KeyManager{
-		client:     client,
-		identifier: identifier,
-		dbs:        dbs,
-		rpc:        rpc,
-		addressMap: make(map[string]*btcec.PrivateKey),
-		params:     params,
+		client:      client,
+		identifier:  identifier,
+		dbs:         dbs,
+		rpc:         rpc,
+		addressMap:  make(map[string]*btcec.PrivateKey),
+		previous:    make(map[string][]string),
+		params:      params,
+		addressType: addressType,
+		seeds:       seeds,
+		log:         log,
 	}
 }
@@ -4,6 +4,7 @@ import "testing"
 import "io/ioutil"
 import "github.com/satori/go.uuid"
 import "gopkg.in/redis.v4"
+import "github.com/btcsuite/btcd/chaincfg"
 import "github.com/btcsuite/btcutil/hdkeychain"
 
 var client *redis.Client
@@ -16,9 +17,23 @@ func init() {
 	})
 }
 
+func newTestKeyManager(t *testing.T, identifier uuid.UUID) *KeyManager {
+	if err := client.Ping().Err(); err != nil {
+		t.Skip("redis is not available:", err)
+	}
+	seeds, err := NewSeedCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewKeyManager(
+		client, identifier, nil, nil, &chaincfg.TestNet3Params,
+		ADDRESS_TYPE_P2PKH, seeds, Log.WithField("session", identifier),
+	)
+}
+
 func TestKeyManagerWorks(t *testing.T) {
 	identifier := uuid.NewV4()
-	manager := NewKeyManager(client, identifier)
+	manager := newTestKeyManager(t, identifier)
 	masterKey := manager.GetMasterKey()
 
 	res1, _ := ioutil.ReadAll(masterKey)
@@ -27,7 +42,7 @@ func TestKeyManagerWorks(t *testing.T) {
 	}
 
 	// Test renewal
-	manager = NewKeyManager(client, identifier)
+	manager = newTestKeyManager(t, identifier)
 	masterKey = manager.GetMasterKey()
 	res2, _ := ioutil.ReadAll(masterKey)
 
@@ -38,7 +53,7 @@ func TestKeyManagerWorks(t *testing.T) {
 
 func TestMasterKeyEntity(t *testing.T) {
 	identifier := uuid.NewV4()
-	manager := NewKeyManager(client, identifier)
+	manager := newTestKeyManager(t, identifier)
 	chain, err := manager.GetChain()
 	t.Log(err)
 	if !chain.IsPrivate() {
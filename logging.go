@@ -0,0 +1,119 @@
+package main
+
+import "context"
+import "crypto/sha256"
+import "encoding/hex"
+import "net/http"
+import "regexp"
+import "time"
+import "github.com/satori/go.uuid"
+import "github.com/sirupsen/logrus"
+
+// Log is the process wide logger. Request scoped entries carrying the
+// request id derive from it through RequestLog.
+var Log = logrus.New()
+
+type logContextKey struct{}
+
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Fields that must never reach the logs, whatever their value.
+var secretFields = map[string]bool{
+	"seed":          true,
+	"password":      true,
+	"cookie":        true,
+	"authorization": true,
+	"tx_hex":        true,
+	"xprv":          true,
+}
+
+// ConfigureLogging sets the level and the output format, json or text.
+func ConfigureLogging(level string, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	Log.SetLevel(lvl)
+	if format == "text" {
+		Log.Formatter = &logrus.TextFormatter{FullTimestamp: true}
+	} else {
+		Log.Formatter = &logrus.JSONFormatter{}
+	}
+	return nil
+}
+
+// SessionTag returns a short, non reversible tag for a session. Session ids
+// are bearer secrets, they derive the session wallet, so logs only carry the
+// tag, which is enough to correlate lines of the same session.
+func SessionTag(session uuid.UUID) string {
+	sum := sha256.Sum256(session.Bytes())
+	return hex.EncodeToString(sum[:6])
+}
+
+// redactHook scrubs secret fields and replaces session ids with their tag
+// before an entry is written.
+type redactHook struct{}
+
+func (h *redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *redactHook) Fire(entry *logrus.Entry) error {
+	for key, value := range entry.Data {
+		if secretFields[key] {
+			entry.Data[key] = "[REDACTED]"
+		} else if session, ok := value.(uuid.UUID); ok {
+			entry.Data[key] = SessionTag(session)
+		}
+	}
+	return nil
+}
+
+func init() {
+	Log.Formatter = &logrus.JSONFormatter{}
+	Log.Hooks.Add(&redactHook{})
+}
+
+// RequestLog returns the logger of a request, tagged with its request id.
+func RequestLog(r *http.Request) *logrus.Entry {
+	if entry, ok := r.Context().Value(logContextKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(Log)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// RequestIdMiddleware tags each request with an id, taken from the
+// X-Request-ID header when the client or proxy sent a sane one, echoes it
+// back and logs the request once served.
+func RequestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get("X-Request-ID")
+		if !requestIdPattern.MatchString(requestId) {
+			requestId = uuid.NewV4().String()
+		}
+		w.Header().Set("X-Request-ID", requestId)
+
+		entry := Log.WithField("request_id", requestId)
+		r = r.WithContext(context.WithValue(r.Context(), logContextKey{}, entry))
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		entry.WithFields(logrus.Fields{
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"status":   recorder.status,
+			"duration": time.Since(start).Seconds(),
+		}).Info("Request served")
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+import "github.com/satori/go.uuid"
+import "github.com/sirupsen/logrus"
+
+func captureLog() *bytes.Buffer {
+	buffer := &bytes.Buffer{}
+	Log.Out = buffer
+	Log.Formatter = &logrus.JSONFormatter{}
+	return buffer
+}
+
+func TestLogRedaction(t *testing.T) {
+	buffer := captureLog()
+	session := uuid.NewV4()
+	Log.WithFields(logrus.Fields{
+		"session": session,
+		"seed":    "deadbeef",
+	}).Info("test")
+
+	line := buffer.String()
+	if strings.Contains(line, session.String()) || strings.Contains(line, "deadbeef") {
+		t.Fatal("secret leaked:", line)
+	}
+	if !strings.Contains(line, SessionTag(session)) {
+		t.Fatal("session tag missing:", line)
+	}
+}
+
+func TestRequestIdMiddleware(t *testing.T) {
+	buffer := captureLog()
+	handler := RequestIdMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RequestLog(r).Info("inside")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequest("GET", "/tiles", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	if res.Header().Get("X-Request-ID") != "abc-123" {
+		t.Fatal("request id not echoed")
+	}
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("expected two log lines, got", lines)
+	}
+	for _, line := range lines {
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["request_id"] != "abc-123" {
+			t.Error("missing request id:", line)
+		}
+	}
+
+	// Ids that could inject into logs are replaced
+	req.Header.Set("X-Request-ID", "bad id\n")
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Header().Get("X-Request-ID") == "bad id\n" {
+		t.Fatal("unsafe request id accepted")
+	}
+}
@@ -3,14 +3,15 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
-	"os/user"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
@@ -21,38 +22,58 @@ import (
 	"github.com/gorilla/securecookie"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/satori/go.uuid"
-	"github.com/spf13/viper"
+	"github.com/sirupsen/logrus"
+	"github.com/skip2/go-qrcode"
 	"gopkg.in/redis.v4"
+
+	"milliondollar/pkg/network"
 )
 
 var (
-	secureCookie     *securecookie.SecureCookie
-	client           *redis.Client
-	tileManager      *TileManager
-	Info             *log.Logger
-	Error            *log.Logger
-	RPCClient        *btcrpcclient.Client
-	BankAddress      btcutil.Address
 	RootPage         []byte
 	IndexRefreshLock sync.RWMutex
-	dbs              *gorm.DB
 	currentDirectory string
-	N_ADS            int
-	AD_COST          float64
-	AD_TTL_MINS      int
-	bank             string
-	net              *chaincfg.Params
 )
 
+// Server holds the configuration and every dependency the handlers use.
+type Server struct {
+	config   *Config
+	redis    *redis.Client
+	dbs      *gorm.DB
+	rpc      *btcrpcclient.Client
+	params   *chaincfg.Params
+	bank     btcutil.Address
+	cookies  []securecookie.Codec
+	csrfKeys [][]byte
+	seeds    *SeedCipher
+	tiles    *TileManager
+	quoter   *PriceQuoter
+	invoices *InvoiceManager
+	auctions *AuctionManager
+	bookings *BookingManager
+	accounts *AccountManager
+	apiKeys  *ApiKeyManager
+	limiter  *RateLimiter
+	draining int32
+}
+
+// UserDetails describes who makes a request: the session whose wallet is
+// used and, when logged in, the account owning it. AccountId is 0 for
+// anonymous sessions, ApiKey is set when authenticated with a key.
 type UserDetails struct {
 	SessionId uuid.UUID
+	AccountId uint
+	ApiKey    *ApiKey
 	Keys      AddressGenerator
+	Log       *logrus.Entry
 }
 
 type AddressBalancePair struct {
 	Address string  `json:"address"`
 	Balance float64 `json:"balance"`
+	URI     string  `json:"uri"`
 }
 
 type TileLockHandlerPayload struct {
@@ -65,24 +86,56 @@ type TilePurchaseHandlerPayload struct {
 }
 
 type PriceHandlerPayload struct {
-	Price float64 `json:"price"`
+	*PriceQuote
+	FrameNumber *int `json:"frame_number,omitempty"`
 }
 
-func PriceMiddleware(w http.ResponseWriter, r *http.Request) {
-	p := &PriceHandlerPayload{
-		Price: AD_COST,
+// PriceMiddleware returns the base price, or the price of a single tile
+// when called with ?tile=N. Fiat deployments get both the fiat price and
+// the BTC amount it converts to.
+func (s *Server) PriceMiddleware(w http.ResponseWriter, r *http.Request) {
+	log := RequestLog(r)
+	p := &PriceHandlerPayload{}
+	var err error
+	if tileParam := r.URL.Query().Get("tile"); tileParam != "" {
+		tile, convErr := strconv.Atoi(tileParam)
+		if convErr != nil || tile < 0 || tile >= s.config.Business.NAds {
+			WriteError(w, log, 400, "invalid tile")
+			return
+		}
+		p.FrameNumber = &tile
+		p.PriceQuote, err = s.quoter.Quote(tile)
+	} else {
+		p.PriceQuote, err = s.quoter.Base()
 	}
-	encoder := json.NewEncoder(w)
-	encoder.Encode(p)
+	if err != nil {
+		WriteError(w, log, 503, err.Error())
+		return
+	}
+	WriteJSON(w, log, 200, p)
 }
 
 func RootHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	IndexRefreshLock.RLock()
 	reader := bytes.NewReader(RootPage)
 	_, err := reader.WriteTo(w)
 	IndexRefreshLock.RUnlock()
 	if err != nil {
-		Error.Fatal(err)
+		RequestLog(r).Errorln("Unable to write root page:", err)
+	}
+}
+
+// WriteJSON writes data with statusCode, logging encoding failures to log.
+// Unversioned aliases get the payload shapes they had before /api/v1.
+func WriteJSON(w http.ResponseWriter, log *logrus.Entry, statusCode int, data interface{}) {
+	if _, ok := w.(legacyWriter); ok {
+		data = legacyPayload(data)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Errorln("Unable to write response:", err)
 	}
 }
 
@@ -92,262 +145,1064 @@ func ResponseByReturnHandler(
 	return func(w http.ResponseWriter, r *http.Request, details *UserDetails) {
 
 		statusCode, data := fn(w, r, details)
-		w.WriteHeader(statusCode)
+		WriteJSON(w, details.Log, statusCode, data)
+	}
+}
+
+// PayBank sends price from the frame address of keys to the bank.
+func (s *Server) PayBank(frameNumber int, keys AddressGenerator, price float64) (string, error) {
+	// Get address in frame and check balance
+	address := keys.MakeAddresses(s.config.Business.NAds)[frameNumber]
+	balance := keys.GetBalanceForAddress(address)
+	if toSatoshis(balance) < toSatoshis(price) {
+		return "", errors.New("funds are insufficient")
+	}
+
+	// Perform transaction
+	addrInstance, _ := btcutil.DecodeAddress(address, s.params)
+	start := time.Now()
+	txid, err := keys.PerformPurchase(addrInstance, price, s.bank)
+	if err != nil {
+		return "", err
+	}
+	purchaseDuration.Observe(time.Since(start).Seconds())
+	RecordPurchase(PAYMENT_MODE_WALLET, price)
+	return txid, nil
+}
 
-		writer := json.NewEncoder(w)
-		err := writer.Encode(data)
+// PayForTile pays for a tile and publishes message on it on behalf of
+// session. Callers must hold s.tiles.PurchaseLock.
+func (s *Server) PayForTile(frameNumber int, session uuid.UUID, keys AddressGenerator, message string, price float64) (string, error) {
+	if err := ValidateMessage(message); err != nil {
+		return "", err
+	}
+
+	// Heartbeats can keep a lock past the window checked when it was taken,
+	// the ad must still be over before the next booking starts
+	if s.bookings != nil {
+		now := time.Now()
+		available, err := s.bookings.Available(frameNumber, now, now.Add(s.config.AdDuration()))
 		if err != nil {
-			Error.Fatal(err)
+			return "", err
+		}
+		if !available {
+			return "", ErrTileBooked
 		}
 	}
+
+	txid, err := s.PayBank(frameNumber, keys, price)
+	if err != nil {
+		return "", err
+	}
+
+	// Set AD for ad_ttl_mins
+	err = s.tiles.PurchaseTile(
+		frameNumber,
+		message,
+		s.config.AdDuration(),
+		session,
+		txid,
+	)
+	return txid, err
+}
+
+// LockedPrice returns the price quoted when session locked the tile,
+// falling back to the current price for locks taken without a quote. Any
+// other error is returned, charging a price other than the quoted one is
+// worse than failing the purchase.
+func (s *Server) LockedPrice(frameNumber int, session uuid.UUID) (float64, error) {
+	quote, err := s.tiles.LockedQuote(frameNumber, session)
+	if err == ErrNoQuote {
+		return s.quoter.PriceForTile(frameNumber)
+	} else if err != nil {
+		return 0, err
+	}
+	return quote.Price, nil
 }
 
-func TilePurchasehandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+func (s *Server) TilePurchasehandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
 	var data TilePurchaseHandlerPayload
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&data)
 	if err != nil {
-		Error.Fatal(err)
+		return 400, NewError(400, "invalid request")
 	}
 
-	// Get address in frame
-	address := details.Keys.MakeAddresses(N_ADS)[data.FrameNumber]
-
-	// Check balance
-	balance := details.Keys.GetBalanceForAddress(address)
-	if balance < AD_COST {
-		return 400, map[string]string{
-			"error": "funds are insufficient",
-		}
+	if data.FrameNumber < 0 || data.FrameNumber >= s.config.Business.NAds {
+		return 400, NewError(400, "invalid frame number")
 	}
 
 	// Only one purchase at a time
-	tileManager.PurchaseLock.Lock()
-	defer tileManager.PurchaseLock.Unlock()
+	s.tiles.PurchaseLock.Lock()
+	defer s.tiles.PurchaseLock.Unlock()
 
 	// Ensure Tile was locked by current user
-	canPurchase, err := tileManager.CanPurchase(data.FrameNumber, details.SessionId)
+	canPurchase, err := s.tiles.CanPurchase(data.FrameNumber, details.SessionId)
 	if !canPurchase {
-		return 400, map[string]string{
-			"error": err.Error(),
-		}
+		return 400, NewError(400, err.Error())
 	}
 
-	// Perform transaction
-	addrInstance, _ := btcutil.DecodeAddress(address, net)
-	txid := details.Keys.PerformPurchase(addrInstance, AD_COST, BankAddress)
-
-	// Set AD for 5 minutes
-	tileManager.PurchaseTile(
-		data.FrameNumber,
-		data.Message,
-		AD_TTL_MINS*time.Minute,
+	price, err := s.LockedPrice(data.FrameNumber, details.SessionId)
+	if err != nil {
+		return 503, NewError(503, err.Error())
+	}
+
+	txid, err := s.PayForTile(
+		data.FrameNumber, details.SessionId, details.Keys, data.Message, price,
 	)
+	if err == ErrTileBooked {
+		return 409, NewError(409, err.Error())
+	} else if err != nil {
+		return 400, NewError(400, err.Error())
+	}
 
 	return 200, map[string]string{
 		"transaction_id": txid,
 	}
 }
 
-func TileLockHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) {
-	var data TileLockHandlerPayload
+// TileEditHandler lets the owner of a running ad replace its message
+// without paying again.
+func (s *Server) TileEditHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	var data TilePurchaseHandlerPayload
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&data); err != nil {
+		return 400, NewError(400, "invalid payload")
+	}
+
+	err := s.tiles.EditTile(data.FrameNumber, data.Message, details.SessionId)
+	if err != nil {
+		return 400, NewError(400, err.Error())
+	}
+
+	return 200, map[string]string{
+		"message": data.Message,
+	}
+}
+
+type TileRenewHandlerPayload struct {
+	FrameNumber int `json:"frame_number"`
+}
+
+// TileRenewHandler lets the owner of a running ad (or of one that expired
+// less than the priority window ago) pay to extend it by ad_ttl_mins.
+func (s *Server) TileRenewHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	var data TileRenewHandlerPayload
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&data); err != nil {
+		return 400, NewError(400, "invalid payload")
+	}
+
+	if data.FrameNumber < 0 || data.FrameNumber >= s.config.Business.NAds {
+		return 400, NewError(400, "invalid frame number")
+	}
+
+	// Auction winners bid again for the next period
+	if s.auctions != nil && s.auctions.IsAuctioned(data.FrameNumber) {
+		return 409, NewError(409, "Auctioned tiles cannot be renewed")
+	}
+
+	// Only one purchase at a time
+	s.tiles.PurchaseLock.Lock()
+	defer s.tiles.PurchaseLock.Unlock()
+
+	owner, err := s.tiles.Owner(data.FrameNumber)
+	if err != nil || !uuid.Equal(owner.SessionId, details.SessionId) {
+		return 400, NewError(400, "Tile is not owned by this user")
+	}
+
+	// The extended ad must not run into a booked slot
+	if s.bookings != nil {
+		ttl, _ := s.redis.PTTL(s.tiles.keyForTile(data.FrameNumber)).Result()
+		if ttl < 0 {
+			ttl = 0
+		}
+		adEnd := time.Now().Add(ttl + s.config.AdDuration())
+		available, err := s.bookings.Available(data.FrameNumber, time.Now(), adEnd)
+		if err != nil || !available {
+			return 400, NewError(400, "Renewal overlaps a booking")
+		}
+	}
+
+	price, err := s.quoter.PriceForTile(data.FrameNumber)
+	if err != nil {
+		return 503, NewError(503, err.Error())
+	}
+
+	txid, err := s.PayBank(data.FrameNumber, details.Keys, price)
+	if err != nil {
+		return 400, NewError(400, err.Error())
+	}
+
+	ttl, err := s.tiles.RenewTile(
+		data.FrameNumber, s.config.AdDuration(), details.SessionId,
+	)
+	if err != nil {
+		details.Log.Errorf("Renewal of tile %d paid in TX %s failed: %s", data.FrameNumber, txid, err)
+		return 500, NewError(500, err.Error()).WithDetails(map[string]string{
+			"transaction_id": txid,
+		})
+	}
+
+	return 200, map[string]interface{}{
+		"transaction_id": txid,
+		"ttl":            ttl / time.Second,
+	}
+}
+
+func (s *Server) InvoiceHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	var data TilePurchaseHandlerPayload
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&data)
 	if err != nil {
-		Error.Fatal(err)
+		return 400, NewError(400, "invalid payload")
+	}
+
+	// Ensure Tile was locked by current user
+	canPurchase, err := s.tiles.CanPurchase(data.FrameNumber, details.SessionId)
+	if !canPurchase {
+		return 400, NewError(400, err.Error())
+	}
+
+	price, err := s.LockedPrice(data.FrameNumber, details.SessionId)
+	if err != nil {
+		return 503, NewError(503, err.Error())
+	}
+
+	invoice, err := s.invoices.NewInvoice(
+		data.FrameNumber, details.SessionId, data.Message, price,
+	)
+	if err != nil {
+		return 400, NewError(400, err.Error())
 	}
+	return 200, invoice
+}
 
-	if data.FrameNumber < 0 || data.FrameNumber >= N_ADS {
-		Error.Fatal("Number of ads invalid")
+func (s *Server) InvoiceStatusHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	invoice, err := s.invoices.Get(mux.Vars(r)["address"])
+	if err != nil || !uuid.Equal(invoice.SessionId, details.SessionId) {
+		return 404, NewError(404, "invoice not found")
 	}
+	return 200, invoice
+}
 
-	err, res := tileManager.Lock(
-		data.FrameNumber, time.Minute*5, details.SessionId,
+type AuctionBidHandlerPayload struct {
+	Amount  float64 `json:"amount"`
+	Message string  `json:"message"`
+}
+
+func (s *Server) AuctionHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	frameNumber, err := strconv.Atoi(mux.Vars(r)["frame"])
+	if err != nil {
+		return 400, NewError(400, "invalid frame number")
+	}
+
+	auction, err := s.auctions.Get(frameNumber, details.SessionId)
+	if err != nil {
+		return 404, NewError(404, err.Error())
+	}
+	return 200, auction
+}
+
+func (s *Server) AuctionBidHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	frameNumber, err := strconv.Atoi(mux.Vars(r)["frame"])
+	if err != nil {
+		return 400, NewError(400, "invalid frame number")
+	}
+
+	var data AuctionBidHandlerPayload
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&data); err != nil {
+		return 400, NewError(400, "invalid payload")
+	}
+
+	auction, err := s.auctions.Bid(
+		frameNumber, details.SessionId, details.Keys, data.Amount, data.Message,
 	)
 	if err != nil {
-		Error.Fatal(err)
+		return 400, NewError(400, err.Error())
+	}
+	return 200, auction
+}
+
+type BookingHandlerPayload struct {
+	FrameNumber int       `json:"frame_number"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Message     string    `json:"message"`
+}
+
+func (s *Server) BookingCalendarHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	frameNumber, err := strconv.Atoi(mux.Vars(r)["frame"])
+	if err != nil || frameNumber < 0 || frameNumber >= s.config.Business.NAds {
+		return 400, NewError(400, "invalid frame number")
 	}
 
-	payload := make(map[string]string)
-	payload["State"] = res
-	encoder := json.NewEncoder(w)
-	err = encoder.Encode(payload)
+	bookings, err := s.bookings.Calendar(frameNumber, details.SessionId)
 	if err != nil {
-		Error.Fatal(err)
+		details.Log.Errorln("Unable to load bookings:", err)
+		return 500, NewError(500, "unable to load bookings")
+	}
+	return 200, map[string]interface{}{
+		"bookings": bookings,
+	}
+}
+
+func (s *Server) BookingHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	var data BookingHandlerPayload
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&data); err != nil {
+		return 400, NewError(400, "invalid payload")
+	}
+
+	booking, err := s.bookings.Book(
+		data.FrameNumber, details.SessionId, details.Keys,
+		data.Start, data.End, data.Message,
+	)
+	if err != nil {
+		return 400, NewError(400, err.Error())
+	}
+	return 200, booking
+}
+
+func (s *Server) TileLockHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	// No new locks while shutting down, they could not be purchased
+	if s.Draining() {
+		lockAttempts.WithLabelValues("draining").Inc()
+		return 503, NewError(503, "Server is shutting down")
+	}
+
+	var data TileLockHandlerPayload
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		return 400, NewError(400, "invalid request")
+	}
+
+	if data.FrameNumber < 0 || data.FrameNumber >= s.config.Business.NAds {
+		return 400, NewError(400, "invalid frame number")
+	}
+
+	// Auctioned tiles are never locked, they go to the highest bidder.
+	// Neither are tiles whose next booking starts before an ad would end.
+	res := STATE_AUCTION
+	available := true
+	if s.bookings != nil {
+		adEnd := time.Now().Add(s.config.LockDuration() + s.config.AdDuration())
+		available, err = s.bookings.Available(data.FrameNumber, time.Now(), adEnd)
+		if err != nil {
+			details.Log.Errorln("Unable to check bookings:", err)
+			return 500, NewError(500, "internal error")
+		}
+	}
+	if !available {
+		res = STATE_BOOKED
+	} else if s.auctions == nil || !s.auctions.IsAuctioned(data.FrameNumber) {
+		quote, err := s.quoter.Quote(data.FrameNumber)
+		if err != nil {
+			lockAttempts.WithLabelValues("no_quote").Inc()
+			return 503, NewError(503, err.Error())
+		}
+
+		err, res = s.tiles.Lock(
+			data.FrameNumber, s.config.LockDuration(), details.SessionId, quote,
+		)
+		if err == ErrLockLimit {
+			lockAttempts.WithLabelValues("limit").Inc()
+			return 409, NewError(409, err.Error())
+		}
+		if err != nil {
+			lockAttempts.WithLabelValues("error").Inc()
+			details.Log.Errorln("Unable to lock tile:", err)
+			return 500, NewError(500, "internal error")
+		}
+	}
+	lockAttempts.WithLabelValues(res).Inc()
+
+	payload := make(map[string]interface{})
+	payload["state"] = res
+
+	// The price quoted with the lock is the one charged on purchase
+	if res == STATE_LOCKED_BY_CURRENT_USER {
+		if quote, err := s.tiles.LockedQuote(data.FrameNumber, details.SessionId); err == nil {
+			payload["quote"] = quote
+		}
+	}
+	return 200, payload
+}
+
+// TileReleaseHandler gives up a lock before it expires. Locks with a pending
+// invoice are kept, the payment may already be on its way.
+func (s *Server) TileReleaseHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	var data TileLockHandlerPayload
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		return 400, NewError(400, "invalid request")
+	}
+
+	if data.FrameNumber < 0 || data.FrameNumber >= s.config.Business.NAds {
+		return 400, NewError(400, "invalid frame number")
+	}
+
+	if s.invoices != nil && s.invoices.Pending(data.FrameNumber, details.SessionId) {
+		return 409, NewError(409, "Tile has a pending invoice")
+	}
+
+	if err := s.tiles.Release(data.FrameNumber, details.SessionId); err != nil {
+		return 400, NewError(400, err.Error())
+	}
+	return 200, map[string]string{
+		"state": STATE_OPEN,
+	}
+}
+
+// TileHeartbeatHandler keeps a lock alive while its holder is still around,
+// up to the maximum hold time.
+func (s *Server) TileHeartbeatHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	var data TileLockHandlerPayload
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		return 400, NewError(400, "invalid request")
+	}
+
+	if data.FrameNumber < 0 || data.FrameNumber >= s.config.Business.NAds {
+		return 400, NewError(400, "invalid frame number")
+	}
+
+	ttl, err := s.tiles.Heartbeat(data.FrameNumber, s.config.LockDuration(), details.SessionId)
+	if err != nil {
+		return 400, NewError(400, err.Error())
+	}
+	return 200, map[string]interface{}{
+		"ttl": int64(ttl / time.Second),
 	}
-	w.Header().Set("Content-Type", "application/json")
 }
 
 type TileMessagePair struct {
 	Message string        `json:"message"`
 	State   string        `json:"state"`
 	TTL     time.Duration `json:"ttl"`
+	Price   float64       `json:"price"`
 }
 
-func TileHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) {
-	states := tileManager.GetState(details.SessionId)
+func (s *Server) TileHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	states, err := s.tiles.GetState(details.SessionId)
+	if err != nil {
+		details.Log.Errorln("Unable to read tile states:", err)
+		return 500, NewError(500, "internal error")
+	}
 	results := make([]*TileMessagePair, len(states))
 	for i, state := range states {
-		key := tileManager.keyForTile(i)
+		key := s.tiles.keyForTile(i)
 
 		message := ""
 		var ttl time.Duration = -1
 		if state != "OPEN" {
-			ttl, _ = client.TTL(key).Result()
+			ttl, _ = s.redis.TTL(key).Result()
 			ttl /= 1000000000
 		}
 
-		if state == "PURCHASED" {
-			bodyKey := tileManager.KeyForBody(i)
-			message, _ = client.Get(bodyKey).Result()
+		if state == STATE_OPEN && s.auctions != nil && s.auctions.IsAuctioned(i) {
+			state = STATE_AUCTION
+		}
+
+		if state == STATE_PURCHASED || state == STATE_PURCHASED_BY_CURRENT {
+			bodyKey := s.tiles.KeyForBody(i)
+			message, _ = s.redis.Get(bodyKey).Result()
+		}
+
+		price, err := s.quoter.PriceForTile(i)
+		if err != nil {
+			details.Log.Errorln("Unable to price tile:", err)
 		}
 
 		results[i] = &TileMessagePair{
 			Message: message,
 			State:   state,
 			TTL:     ttl,
+			Price:   price,
 		}
 	}
-	encoder := json.NewEncoder(w)
-	err := encoder.Encode(results)
+	return 200, map[string]interface{}{
+		"tiles": results,
+	}
+}
+
+type AccountHandlerPayload struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type AccountWalletHandlerPayload struct {
+	WalletId uint `json:"wallet_id"`
+}
+
+type AccountWalletResponse struct {
+	Id      uint      `json:"id"`
+	Created time.Time `json:"created"`
+	Active  bool      `json:"active"`
+}
+
+// login starts a login session for account and links the current wallet to
+// it, so funds sent before registering are not lost. A wallet of another
+// account is swapped for one of this account.
+func (s *Server) login(w http.ResponseWriter, account *Account, details *UserDetails) (int, interface{}) {
+	session, err := walletForLogin(s.accounts, account.ID, details.SessionId)
+	if err == nil && !uuid.Equal(session, details.SessionId) {
+		details.Log.Infoln("Current wallet belongs to another account, switching")
+		if err = s.issueSession(w, session); err == nil {
+			s.setSessionCookie(w, CSRF_COOKIE, CSRFToken(s.csrfKeys[0], session), false)
+		}
+	}
+	if err != nil {
+		details.Log.Errorln("Unable to pick a wallet:", err)
+		return 500, NewError(500, "internal error")
+	}
+
+	token, err := s.accounts.Login(account.ID)
+	if err == nil {
+		err = s.issueLogin(w, token)
+	}
 	if err != nil {
-		Error.Fatal(err)
+		details.Log.Errorln("Unable to log in:", err)
+		return 500, NewError(500, "internal error")
 	}
+	details.Log.WithField("account", account.ID).Infoln("Logged in")
+	return 200, map[string]string{
+		"email": account.Email,
+	}
+}
+
+func (s *Server) AccountRegisterHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	var data AccountHandlerPayload
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		return 400, NewError(400, "invalid payload")
+	}
+
+	account, err := s.accounts.Register(data.Email, data.Password)
+	if err != nil {
+		return 400, NewError(400, err.Error())
+	}
+	return s.login(w, account, details)
 }
 
-func AuthMiddleware(fn func(http.ResponseWriter, *http.Request, *UserDetails)) func(http.ResponseWriter, *http.Request) {
+func (s *Server) AccountLoginHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	var data AccountHandlerPayload
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		return 400, NewError(400, "invalid payload")
+	}
+
+	account, err := s.accounts.Authenticate(data.Email, data.Password)
+	if err == ErrInvalidCredentials {
+		return 401, NewError(401, err.Error())
+	} else if err != nil {
+		details.Log.Errorln("Unable to authenticate:", err)
+		return 500, NewError(500, "internal error")
+	}
+	return s.login(w, account, details)
+}
+
+// AccountLogoutHandler ends the login session and forgets the wallet when
+// the account owns it, the next visitor of a shared browser starts with a
+// fresh session.
+func (s *Server) AccountLogoutHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	if details.AccountId == 0 {
+		return 401, NewError(401, "not logged in")
+	}
+
+	if cookie, err := r.Cookie("account"); err == nil {
+		if token, _, err := s.decodeLogin(cookie.Value); err == nil {
+			if err := s.accounts.Logout(token); err != nil {
+				details.Log.Errorln("Unable to log out:", err)
+				return 500, NewError(500, "internal error")
+			}
+		}
+	}
+	s.clearCookie(w, "account")
+
+	// Only forget a wallet the account brings back on the next login,
+	// the cookie is the only key to any other
+	owner, err := s.accounts.WalletOwner(details.SessionId)
+	if err != nil {
+		details.Log.Errorln("Unable to check wallet owner:", err)
+	} else if owner == details.AccountId {
+		s.clearCookie(w, "uuid")
+	}
+	return 200, map[string]string{}
+}
+
+func (s *Server) AccountHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	if details.AccountId == 0 {
+		return 401, NewError(401, "not logged in")
+	}
+
+	account, err := s.accounts.Get(details.AccountId)
+	if err != nil {
+		details.Log.Errorln("Unable to load account:", err)
+		return 500, NewError(500, "internal error")
+	}
+	wallets, err := s.accounts.Wallets(details.AccountId)
+	if err != nil {
+		details.Log.Errorln("Unable to load wallets:", err)
+		return 500, NewError(500, "internal error")
+	}
+
+	response := make([]AccountWalletResponse, len(wallets))
+	for i, wallet := range wallets {
+		response[i] = AccountWalletResponse{
+			Id:      wallet.ID,
+			Created: wallet.CreatedAt,
+			Active:  wallet.SessionId == details.SessionId.String(),
+		}
+	}
+	return 200, map[string]interface{}{
+		"email":   account.Email,
+		"wallets": response,
+	}
+}
+
+// AccountWalletHandler switches the session to another wallet of the
+// account.
+func (s *Server) AccountWalletHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	if details.AccountId == 0 {
+		return 401, NewError(401, "not logged in")
+	}
+
+	var data AccountWalletHandlerPayload
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		return 400, NewError(400, "invalid payload")
+	}
+
+	wallets, err := s.accounts.Wallets(details.AccountId)
+	if err != nil {
+		details.Log.Errorln("Unable to load wallets:", err)
+		return 500, NewError(500, "internal error")
+	}
+	for _, wallet := range wallets {
+		if wallet.ID != data.WalletId {
+			continue
+		}
+		session, err := uuid.FromString(wallet.SessionId)
+		if err == nil {
+			err = s.issueSession(w, session)
+		}
+		if err != nil {
+			details.Log.Errorln("Unable to switch wallet:", err)
+			return 500, NewError(500, "internal error")
+		}
+		s.setSessionCookie(w, CSRF_COOKIE, CSRFToken(s.csrfKeys[0], session), false)
+		return 200, AccountWalletResponse{
+			Id:      wallet.ID,
+			Created: wallet.CreatedAt,
+			Active:  true,
+		}
+	}
+	return 404, NewError(404, "unknown wallet")
+}
+
+type ApiKeyCreateHandlerPayload struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+type ApiKeyResponse struct {
+	Id      uint       `json:"id"`
+	Name    string     `json:"name"`
+	Prefix  string     `json:"prefix"`
+	Scope   string     `json:"scope"`
+	Created time.Time  `json:"created"`
+	Revoked *time.Time `json:"revoked,omitempty"`
+	Key     string     `json:"key,omitempty"`
+}
+
+func NewApiKeyResponse(apiKey *ApiKey) ApiKeyResponse {
+	return ApiKeyResponse{
+		Id:      apiKey.ID,
+		Name:    apiKey.Name,
+		Prefix:  apiKey.Prefix,
+		Scope:   apiKey.Scope,
+		Created: apiKey.CreatedAt,
+		Revoked: apiKey.RevokedAt,
+	}
+}
+
+func (s *Server) ApiKeysHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	keys, err := s.apiKeys.List(details.AccountId, details.SessionId)
+	if err != nil {
+		details.Log.Errorln("Unable to list API keys:", err)
+		return 500, NewError(500, "internal error")
+	}
+
+	response := make([]ApiKeyResponse, len(keys))
+	for i := range keys {
+		response[i] = NewApiKeyResponse(&keys[i])
+	}
+	return 200, map[string]interface{}{
+		"api_keys": response,
+	}
+}
+
+// ApiKeyCreateHandler issues a key acting as the current session. The key
+// is part of this response only.
+func (s *Server) ApiKeyCreateHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	var data ApiKeyCreateHandlerPayload
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		return 400, NewError(400, "invalid payload")
+	}
+
+	key, apiKey, err := s.apiKeys.Create(details.AccountId, details.SessionId, data.Name, data.Scope)
+	if err != nil {
+		return 400, NewError(400, err.Error())
+	}
+	details.Log.WithField("api_key", apiKey.ID).Infoln("Issued API key with scope", apiKey.Scope)
+
+	response := NewApiKeyResponse(apiKey)
+	response.Key = key
+	return 200, response
+}
+
+func (s *Server) ApiKeyRevokeHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return 400, NewError(400, "invalid API key id")
+	}
+
+	if err := s.apiKeys.Revoke(details.AccountId, details.SessionId, uint(id)); err != nil {
+		return 404, NewError(404, err.Error())
+	}
+	details.Log.WithField("api_key", id).Infoln("Revoked API key")
+	return 200, map[string]string{}
+}
+
+func (s *Server) KeysForSession(session uuid.UUID) AddressGenerator {
+	return s.keysWithLog(session, Log.WithField("session", session))
+}
+
+func (s *Server) keysWithLog(session uuid.UUID, log *logrus.Entry) AddressGenerator {
+	return NewKeyManager(
+		s.redis, session, s.dbs, s.rpc, s.params,
+		s.config.Business.AddressType, s.seeds, log,
+	)
+}
+
+func (s *Server) AuthMiddleware(fn func(http.ResponseWriter, *http.Request, *UserDetails)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			s.apiKeyAuth(w, r, fn)
+			return
+		}
 
-		// Get cookies
+		log := RequestLog(r)
+
+		// Get cookies, a cookie that does not decode starts a new session
 		uuidFetched := false
+		staleCookie := false
 		var uniqueIdentifier uuid.UUID
 		if cookie, err := r.Cookie("uuid"); err == nil {
-			value := make(map[string]string)
-			if err = secureCookie.Decode("uuid", cookie.Value, &value); err == nil {
-				uniqueIdentifier, err = uuid.FromString(value["uuid"])
-				if err != nil {
-					Error.Fatal(err)
+			uniqueIdentifier, staleCookie, err = s.decodeSession(cookie.Value)
+			uuidFetched = err == nil
+			if !uuidFetched {
+				log.Warnln("Ignoring invalid session cookie:", err)
+			}
+		}
+
+		// Logged in accounts get their latest wallet back when the session
+		// cookie is gone
+		var accountId uint
+		if cookie, err := r.Cookie("account"); err == nil {
+			token, staleLogin, err := s.decodeLogin(cookie.Value)
+			if err == nil {
+				accountId, err = s.accounts.AccountForLogin(token)
+			}
+			if err != nil {
+				accountId = 0
+				log.Debugln("Ignoring invalid account cookie:", err)
+			} else if staleLogin {
+				// Move the login to the current key before the old one is dropped
+				if err := s.issueLogin(w, token); err != nil {
+					log.Errorln("Unable to encode account cookie:", err)
 				}
-				uuidFetched = true
-			} else {
-				Error.Fatal(err)
 			}
 		}
 
-		if !uuidFetched {
+		// State changing requests need an existing session and its token
+		if !IsSafeMethod(r.Method) && (!uuidFetched || !ValidCSRF(s.csrfKeys, r, uniqueIdentifier)) {
+			log.Warnln("Rejecting request with a missing or invalid CSRF token")
+			WriteError(w, log, 403, "invalid CSRF token")
+			return
+		}
+
+		restored := false
+		if !uuidFetched && accountId != 0 {
+			wallets, err := s.accounts.Wallets(accountId)
+			if err == nil && len(wallets) > 0 {
+				uniqueIdentifier, err = uuid.FromString(wallets[0].SessionId)
+				restored = err == nil
+			}
+		}
+
+		if !uuidFetched && !restored {
+			// Every new session has its own wallet, so minting them is limited
+			ip := ClientIP(r, s.config.RateLimit.TrustProxy)
+			if !s.checkRateLimit(w, r, "session", s.config.RateLimit.Session, "ip:"+ip) {
+				return
+			}
+
 			uniqueIdentifier = uuid.NewV4()
-			value := map[string]string{
-				"uuid": uniqueIdentifier.String(),
+			if accountId != 0 {
+				if err := s.accounts.LinkWallet(accountId, uniqueIdentifier); err != nil {
+					log.Errorln("Unable to link new wallet to account:", err)
+				}
 			}
-			if encoded, err := secureCookie.Encode("uuid", value); err == nil {
-				http.SetCookie(w, &http.Cookie{
-					Name:  "uuid",
-					Value: encoded,
-				})
-			} else {
-				Error.Fatal(err)
+		}
+
+		// New sessions get a cookie, old ones move to the current key
+		if !uuidFetched || staleCookie {
+			if err := s.issueSession(w, uniqueIdentifier); err != nil {
+				log.Errorln("Unable to encode session cookie:", err)
+				WriteError(w, log, 500, "internal error")
+				return
 			}
 		}
-		manager := NewKeyManager(client, uniqueIdentifier, dbs, RPCClient, net)
+
+		// Hand the page the token it needs for POST requests
+		csrfToken := CSRFToken(s.csrfKeys[0], uniqueIdentifier)
+		if cookie, err := r.Cookie(CSRF_COOKIE); err != nil || cookie.Value != csrfToken {
+			s.setSessionCookie(w, CSRF_COOKIE, csrfToken, false)
+		}
+
+		log = log.WithField("session", uniqueIdentifier)
+		if accountId != 0 {
+			log = log.WithField("account", accountId)
+		}
 		details := &UserDetails{
 			SessionId: uniqueIdentifier,
-			Keys:      manager,
+			AccountId: accountId,
+			Keys:      s.keysWithLog(uniqueIdentifier, log),
+			Log:       log,
 		}
 
 		fn(w, r, details)
 	}
 }
 
-func AddressesHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) {
+func (s *Server) AddressesHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) (int, interface{}) {
 
 	// Get keypair
-	Info.Println(details.SessionId.String())
-	pkeys := details.Keys.MakeAddresses(N_ADS)
+	pkeys := details.Keys.MakeAddresses(s.config.Business.NAds)
 
 	res := make([]*AddressBalancePair, len(pkeys))
 	balances := details.Keys.GetAddressBalances(len(pkeys))
 	for idx, key := range pkeys {
+		// Without a price the URI simply carries no amount
+		price, _ := s.quoter.PriceForTile(idx)
 		res[idx] = &AddressBalancePair{
 			Address: key,
 			Balance: balances[idx],
+			URI:     PaymentURI(key, AmountNeeded(price, balances[idx]), s.paymentLabel(idx)),
 		}
 	}
 
-	encoder := json.NewEncoder(w)
-	encoder.Encode(res)
-	w.Header().Set("Content-Type", "application/json")
+	return 200, map[string]interface{}{
+		"addresses": res,
+	}
 }
 
-func init() {
-	// Initialize loggers
-	Info = log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	Error = log.New(os.Stdout, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
+func (s *Server) paymentLabel(frameNumber int) string {
+	return fmt.Sprintf("%s tile %d", s.config.Business.PaymentLabel, frameNumber)
+}
+
+// AddressQRHandler renders the BIP21 URI of a frame address as a PNG.
+func (s *Server) AddressQRHandler(w http.ResponseWriter, r *http.Request, details *UserDetails) {
+	frameNumber, err := strconv.Atoi(mux.Vars(r)["frame"])
+	if err != nil || frameNumber < 0 || frameNumber >= s.config.Business.NAds {
+		WriteError(w, details.Log, 400, "invalid frame number")
+		return
+	}
+
+	address := details.Keys.MakeAddresses(s.config.Business.NAds)[frameNumber]
+	balance := details.Keys.GetBalanceForAddress(address)
 
+	// The UI shows this code while the tile is locked, ask for the quote
+	price, err := s.LockedPrice(frameNumber, details.SessionId)
+	if err != nil {
+		price, _ = s.quoter.PriceForTile(frameNumber)
+	}
+	uri := PaymentURI(address, AmountNeeded(price, balance), s.paymentLabel(frameNumber))
+
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		details.Log.Errorln("Unable to render QR code:", err)
+		WriteError(w, details.Log, 500, "unable to render QR code")
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
+
+func init() {
 	// get current directory of file
 	_, filename, _, _ := runtime.Caller(1)
 	currentDirectory = path.Dir(filename)
+}
+
+// NewServer connects to Redis, Postgres and btcd and builds the managers
+// described by config.
+func NewServer(config *Config) (*Server, error) {
+	s := &Server{config: config}
+
+	var err error
+	s.params, err = config.NetworkParams()
+	if err != nil {
+		return nil, err
+	}
+	Log.Infoln("Using", s.params.Name)
+	s.bank, err = btcutil.DecodeAddress(config.Business.Bank, s.params)
+	if err != nil {
+		return nil, err
+	}
 
-	// add configuration directory
-	viper.SetConfigName("app")
-	usr, _ := user.Current()
-	viper.AddConfigPath(filepath.Join(usr.HomeDir, ".mdp/"))
-	err := viper.ReadInConfig()
+	// Per tile pricing rules on top of the base ad_cost
+	pricer, err := NewPricer(config.Business.AdCost, config.Business.Pricing)
 	if err != nil {
-		Error.Fatal(err)
+		return nil, err
+	}
+
+	// Prices are in BTC unless a fiat currency is configured
+	var rates RateProvider
+	if config.Business.Currency != "" {
+		var provider RateProvider
+		if config.Rates.Provider == "file" {
+			provider = &FileRateProvider{Path: config.Rates.File}
+		} else {
+			provider = &HTTPRateProvider{
+				URL:    config.Rates.URL,
+				Client: &http.Client{Timeout: time.Second * 10},
+			}
+		}
+		rates = NewCachedRateProvider(
+			provider,
+			time.Duration(config.Rates.CacheSecs)*time.Second,
+			time.Duration(config.Rates.MaxStalenessSecs)*time.Second,
+		)
 	}
-	N_ADS = viper.GetInt("business.n_ads")
-	AD_COST = viper.GetFloat64("business.ad_cost")
-	AD_TTL_MINS = viper.GetInt("business.ad_ttl_mins")
+	s.quoter = NewPriceQuoter(pricer, rates, config.Business.Currency)
 
 	// Initialize Cookies
-	secureCookie = securecookie.New(
-		[]byte(viper.GetString("cookie.key2")),
-		[]byte(viper.GetString("cookie.key1")),
-	)
+	s.cookies = CookieCodecs(config.Cookie)
+	s.csrfKeys = CSRFKeys(config.Cookie)
+
+	// Initialize seed encryption, previous keys are kept for decryption only
+	if config.Security.SeedKey != "" || config.Security.SeedKeyFile != "" {
+		seedKey, err := LoadSeedKey(config.Security.SeedKey, config.Security.SeedKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		seedKeys := [][]byte{seedKey}
+		for _, oldKeyFile := range config.Security.OldSeedKeyFiles {
+			oldKey, err := LoadSeedKey("", oldKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			seedKeys = append(seedKeys, oldKey)
+		}
+		s.seeds, err = NewSeedCipher(seedKeys...)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Initialize Redis
-	client = redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("db.redis"),
+	s.redis = redis.NewClient(&redis.Options{
+		Addr:     config.DB.Redis,
 		Password: "", // no password set
 		DB:       0,  // use default DB
 	})
 
 	// Initialize PG
-	dbs, err = gorm.Open("postgres", viper.GetString("db.pg"))
+	s.dbs, err = gorm.Open("postgres", config.DB.PG)
 	if err != nil {
-		Error.Fatal(err)
+		return nil, err
 	}
 
 	// Initialize BTCD
 	btcdHomeDir := btcutil.AppDataDir("btcd", false)
 	certs, err := ioutil.ReadFile(filepath.Join(btcdHomeDir, "rpc.cert"))
 	if err != nil {
-		Error.Fatal(err)
+		return nil, err
 	}
 	connCfg := &btcrpcclient.ConnConfig{
-		Host:         viper.GetString("db.btcd.host"),
+		Host:         config.DB.Btcd.Host,
 		Endpoint:     "ws",
-		User:         viper.GetString("db.btcd.username"),
-		Pass:         viper.GetString("db.btcd.password"),
+		User:         config.DB.Btcd.Username,
+		Pass:         config.DB.Btcd.Password,
 		Certificates: certs,
 	}
-	RPCClient, err = btcrpcclient.New(connCfg, nil)
+	s.rpc, err = btcrpcclient.New(connCfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := network.CheckNode(s.rpc, s.params); err != nil {
+		return nil, err
+	}
+
+	s.limiter = NewRateLimiter(s.redis)
+
+	s.accounts, err = NewAccountManager(s.dbs, s.redis)
+	if err != nil {
+		return nil, err
+	}
+
+	s.apiKeys, err = NewApiKeyManager(s.dbs)
 	if err != nil {
-		Error.Fatal(err)
+		return nil, err
 	}
 
-	// Init the tile manager and redeem adress
-	tileManager = NewTileManager(N_ADS, client)
-	bank = viper.GetString("business.bank")
+	// Init the tile manager
+	s.tiles = NewTileManager(
+		config.Business.NAds, s.redis,
+		time.Duration(config.Business.RenewPriorityMins)*time.Minute,
+		config.Business.MaxLocks,
+		time.Duration(config.Business.MaxLockHoldMins)*time.Minute,
+	)
 
-	// Get params
-	if viper.GetBool("db.btcd.is_simnet") {
-		Info.Println("Using SimNet")
-		net = &chaincfg.SimNetParams
+	// Payment mode, either per-session hot wallets or invoices on an xpub
+	if config.Business.PaymentMode == PAYMENT_MODE_INVOICE {
+		s.invoices, err = NewInvoiceManager(
+			config.Business.Xpub,
+			s.redis, s.dbs, s.tiles, s.params, config.Business.AddressType,
+			time.Duration(config.Business.InvoiceTTLMins)*time.Minute,
+			config.AdDuration(),
+		)
+		if err != nil {
+			return nil, err
+		}
 	} else {
-		Info.Println("Using MainNet")
-		net = &chaincfg.MainNetParams
+		s.auctions, err = NewAuctionManager(
+			s.redis, s.tiles, s.quoter, config.Business.Auction,
+			s.KeysForSession, s.PayForTile,
+		)
+		if err != nil {
+			return nil, err
+		}
+		s.bookings = NewBookingManager(
+			s.redis, s.tiles, s.quoter, s.auctions,
+			config.AdDuration(),
+			time.Duration(config.Business.Booking.MaxAdvanceDays)*24*time.Hour,
+			s.PayBank,
+		)
 	}
+	return s, nil
 }
 
 func refreshRootPage() error {
@@ -357,6 +1212,34 @@ func refreshRootPage() error {
 }
 
 func main() {
+	configPath := flag.String("config", "", "path to the configuration file (default ~/.mdp/app.*)")
+	flag.Parse()
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	if err := ConfigureLogging(config.Log.Level, config.Log.Format); err != nil {
+		Log.Fatal(err)
+	}
+	s, err := NewServer(config)
+	if err != nil {
+		Log.Fatal(err)
+	}
+
+	// Key rotation: rewrite all stored seeds under the current key and exit
+	if flag.Arg(0) == "reencrypt-seeds" {
+		if s.seeds == nil {
+			Log.Fatal("No seed encryption key configured")
+		}
+		count, err := ReencryptSeeds(s.redis, s.seeds)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		Log.Infof("Re-encrypted %d session seeds", count)
+		return
+	}
+
 	refreshRootPage()
 
 	// Refresh root periodically
@@ -366,26 +1249,38 @@ func main() {
 			IndexRefreshLock.Lock()
 			refreshRootPage()
 			IndexRefreshLock.Unlock()
-			Info.Println("Refreshed root page")
+			Log.Debugln("Refreshed root page")
 		}
 	}()
 
-	// Get Address for purchase
-	var err error
-	BankAddress, err = btcutil.DecodeAddress(bank, net)
-	if err != nil {
-		Error.Fatal(err)
+	if s.invoices != nil {
+		go s.invoices.Watch(time.Second * 5)
+	}
+	if s.auctions != nil {
+		go s.auctions.Watch(time.Second * 5)
+	}
+	if s.bookings != nil {
+		go s.bookings.Watch(time.Second * 5)
 	}
 
 	// address router
-	Info.Println(currentDirectory)
+	Log.Debugln("Serving static files from", currentDirectory)
 	r := mux.NewRouter()
-	r.HandleFunc("/price", PriceMiddleware).Methods("GET")
-	r.HandleFunc("/addresses", AuthMiddleware(AddressesHandler)).Methods("GET")
-	r.HandleFunc("/tiles", AuthMiddleware(TileHandler)).Methods("GET")
-	r.HandleFunc("/tile", AuthMiddleware(TileLockHandler)).Methods("POST")
-	r.HandleFunc("/purchase", AuthMiddleware(ResponseByReturnHandler(TilePurchasehandler))).Methods("POST")
+	r.MethodNotAllowedHandler = http.HandlerFunc(apiMethodNotAllowed)
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", HealthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", s.ReadyzHandler).Methods("GET")
+	s.APIRoutes(r.PathPrefix(API_PREFIX).Subrouter())
 	r.HandleFunc("/", RootHandler).Methods("GET")
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(currentDirectory+"/static/"))))
-	Error.Fatal(http.ListenAndServe(":8000", r))
+
+	// Unversioned routes stay around until clients moved to /api/v1
+	legacy := mux.NewRouter()
+	s.APIRoutes(legacy)
+	legacy.NotFoundHandler = http.HandlerFunc(apiNotFound)
+	r.NotFoundHandler = Deprecated(legacy)
+	if err := s.Serve(RequestIdMiddleware(RecoverMiddleware(r))); err != nil && err != http.ErrServerClosed {
+		Log.Fatal(err)
+	}
+	Log.Infoln("Shut down cleanly")
 }
@@ -0,0 +1,66 @@
+package main
+
+import "time"
+import "github.com/prometheus/client_golang/prometheus"
+import "gopkg.in/redis.v4"
+
+var (
+	lockAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mdp_lock_attempts_total",
+		Help: "Tile lock attempts by outcome.",
+	}, []string{"outcome"})
+
+	purchases = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mdp_purchases_total",
+		Help: "Completed purchases by payment mode.",
+	}, []string{"mode"})
+
+	revenue = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mdp_revenue_btc_total",
+		Help: "BTC received for purchases by payment mode.",
+	}, []string{"mode"})
+
+	purchaseDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mdp_purchase_duration_seconds",
+		Help:    "Time taken to build, sign and broadcast a purchase.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+
+	backendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mdp_backend_call_duration_seconds",
+		Help:    "Latency of Redis, Postgres and btcd calls.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"backend", "op"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mdp_rate_limited_total",
+		Help: "Requests refused with 429 by limit.",
+	}, []string{"limit"})
+
+	backendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mdp_backend_call_errors_total",
+		Help: "Failed Redis, Postgres and btcd calls.",
+	}, []string{"backend", "op"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		lockAttempts, purchases, revenue, purchaseDuration,
+		backendDuration, backendErrors, rateLimited,
+	)
+}
+
+// ObserveCall records the latency of a backend call started at start,
+// counting it as failed when err is set. A missing Redis key is not an error.
+func ObserveCall(backend string, op string, start time.Time, err error) {
+	backendDuration.WithLabelValues(backend, op).Observe(time.Since(start).Seconds())
+	if err != nil && err != redis.Nil {
+		backendErrors.WithLabelValues(backend, op).Inc()
+	}
+}
+
+// RecordPurchase counts a completed purchase and the amount paid for it.
+func RecordPurchase(mode string, amount float64) {
+	purchases.WithLabelValues(mode).Inc()
+	revenue.WithLabelValues(mode).Add(amount)
+}
@@ -0,0 +1,110 @@
+package main
+
+import "encoding/json"
+import "io/ioutil"
+import "reflect"
+import "sort"
+import "strings"
+import "testing"
+
+type openAPISchema struct {
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type openAPISpec struct {
+	Paths      map[string]map[string]interface{} `json:"paths"`
+	Components struct {
+		Schemas map[string]openAPISchema `json:"schemas"`
+	} `json:"components"`
+}
+
+func loadSpec(t *testing.T) *openAPISpec {
+	data, err := ioutil.ReadFile("api/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &openAPISpec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// jsonFields lists the JSON names of the fields of a struct.
+func jsonFields(value interface{}) []string {
+	var fields []string
+	typ := reflect.TypeOf(value)
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	spec := loadSpec(t)
+
+	served := make(map[string]bool)
+	for _, mode := range []string{PAYMENT_MODE_WALLET, PAYMENT_MODE_INVOICE} {
+		config := validConfig()
+		config.Business.PaymentMode = mode
+		s := &Server{config: config}
+		for _, route := range s.APIRouteTable() {
+			served[route.Method+" "+route.Path] = true
+			if _, ok := spec.Paths[route.Path][strings.ToLower(route.Method)]; !ok {
+				t.Errorf("%s %s is not documented", route.Method, route.Path)
+			}
+		}
+	}
+
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			if !served[strings.ToUpper(method)+" "+path] {
+				t.Errorf("%s %s is documented but not served", method, path)
+			}
+		}
+	}
+}
+
+func TestOpenAPISchemasMatchTypes(t *testing.T) {
+	spec := loadSpec(t)
+
+	types := map[string]interface{}{
+		"APIError":        APIError{},
+		"PriceQuote":      PriceQuote{},
+		"Tile":            TileMessagePair{},
+		"Address":         AddressBalancePair{},
+		"Invoice":         Invoice{},
+		"Booking":         Booking{},
+		"Bid":             PublicBid{},
+		"Auction":         Auction{},
+		"AccountWallet":   AccountWalletResponse{},
+		"ApiKey":          ApiKeyResponse{},
+		"TileRequest":     TileLockHandlerPayload{},
+		"PurchaseRequest": TilePurchaseHandlerPayload{},
+		"BookingRequest":  BookingHandlerPayload{},
+		"BidRequest":      AuctionBidHandlerPayload{},
+		"Credentials":     AccountHandlerPayload{},
+		"WalletRequest":   AccountWalletHandlerPayload{},
+		"ApiKeyRequest":   ApiKeyCreateHandlerPayload{},
+	}
+	for name, value := range types {
+		schema, ok := spec.Components.Schemas[name]
+		if !ok {
+			t.Errorf("schema %s is missing", name)
+			continue
+		}
+		var properties []string
+		for property := range schema.Properties {
+			properties = append(properties, property)
+		}
+		sort.Strings(properties)
+
+		if fields := jsonFields(value); !reflect.DeepEqual(fields, properties) {
+			t.Errorf("schema %s has %v, %T has %v", name, properties, value, fields)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "net/url"
+import "strconv"
+import "strings"
+import "github.com/btcsuite/btcutil"
+
+// PaymentURI builds a BIP21 URI for address. The amount is omitted when
+// nothing is left to pay.
+func PaymentURI(address string, amount float64, label string) string {
+	params := url.Values{}
+	if amount > 0 {
+		// Round to satoshis so the wallet gets an exact amount
+		sats, err := btcutil.NewAmount(amount)
+		if err == nil {
+			params.Set("amount", strconv.FormatFloat(sats.ToBTC(), 'f', -1, 64))
+		}
+	}
+	if label != "" {
+		params.Set("label", label)
+	}
+
+	uri := "bitcoin:" + address
+	if len(params) > 0 {
+		// BIP21 expects %20 rather than + for spaces
+		uri += "?" + strings.Replace(params.Encode(), "+", "%20", -1)
+	}
+	return uri
+}
+
+// AmountNeeded returns how much is still to be paid into an address holding
+// balance for an item costing price.
+func AmountNeeded(price float64, balance float64) float64 {
+	if balance >= price {
+		return 0
+	}
+	return price - balance
+}
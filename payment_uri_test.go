@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestPaymentURI(t *testing.T) {
+	uri := PaymentURI("1BoatSLRHtKNngkdXEeobR76b53LETtpyT", 0.0015, "Tile 3")
+	expected := "bitcoin:1BoatSLRHtKNngkdXEeobR76b53LETtpyT?amount=0.0015&label=Tile%203"
+	if uri != expected {
+		t.Errorf("expected %s, got %s", expected, uri)
+	}
+
+	// Nothing left to pay
+	uri = PaymentURI("1BoatSLRHtKNngkdXEeobR76b53LETtpyT", AmountNeeded(0.1, 0.2), "")
+	if uri != "bitcoin:1BoatSLRHtKNngkdXEeobR76b53LETtpyT" {
+		t.Errorf("unexpected uri %s", uri)
+	}
+}
@@ -0,0 +1,199 @@
+// Package client talks to the /api/v1 JSON API of a Million Dollar Page
+// server, authenticating with an API key. api/openapi.json describes the
+// same API for other languages.
+package client
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "io"
+import "net/http"
+import "strconv"
+import "strings"
+import "time"
+
+const API_PREFIX = "/api/v1"
+
+// Tile states, as found in Tile.State and LockResult.State.
+const (
+	STATE_OPEN                   = "OPEN"
+	STATE_LOCKED_BY_OTHER        = "LOCKED_BY_OTHER"
+	STATE_LOCKED_BY_CURRENT_USER = "LOCKED_BY_CURRENT_USER"
+	STATE_PURCHASED              = "PURCHASED"
+	STATE_PURCHASED_BY_CURRENT   = "PURCHASED_BY_CURRENT_USER"
+	STATE_AUCTION                = "AUCTION"
+	STATE_BOOKED                 = "BOOKED"
+)
+
+type PriceQuote struct {
+	Price     float64 `json:"price"`
+	FiatPrice float64 `json:"fiat_price,omitempty"`
+	Currency  string  `json:"currency,omitempty"`
+}
+
+// Tile is the public state of a tile. TTL is in seconds, -1 when open.
+type Tile struct {
+	Message string  `json:"message"`
+	State   string  `json:"state"`
+	TTL     int64   `json:"ttl"`
+	Price   float64 `json:"price"`
+}
+
+// Address is where the funds for a tile go and what it received so far.
+type Address struct {
+	Address string  `json:"address"`
+	Balance float64 `json:"balance"`
+	URI     string  `json:"uri"`
+}
+
+// LockResult carries the quote the purchase will be charged at when the
+// lock was taken.
+type LockResult struct {
+	State string      `json:"state"`
+	Quote *PriceQuote `json:"quote,omitempty"`
+}
+
+// Error is a failed request. Code is one of the codes listed in the
+// OpenAPI document.
+type Error struct {
+	Status  int                    `json:"-"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+type Client struct {
+	BaseURL    string
+	APIKey     string
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL, e.g.
+// https://example.com. Purchases need a key with the purchase scope.
+func New(baseURL string, apiKey string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do sends body as JSON and decodes the response into out, or into an
+// *Error when the server answers with one.
+func (c *Client) do(method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.BaseURL+API_PREFIX+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		var envelope struct {
+			Error *Error `json:"error"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&envelope); err != nil || envelope.Error == nil {
+			return &Error{
+				Status:  res.StatusCode,
+				Code:    "unknown",
+				Message: res.Status,
+			}
+		}
+		envelope.Error.Status = res.StatusCode
+		return envelope.Error
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+type tileRequest struct {
+	FrameNumber int `json:"frame_number"`
+}
+
+type purchaseRequest struct {
+	FrameNumber int    `json:"frame_number"`
+	Message     string `json:"message"`
+}
+
+// Price returns the current price of tile.
+func (c *Client) Price(tile int) (*PriceQuote, error) {
+	quote := &PriceQuote{}
+	err := c.do("GET", "/price?tile="+strconv.Itoa(tile), nil, quote)
+	return quote, err
+}
+
+func (c *Client) Tiles() ([]Tile, error) {
+	var res struct {
+		Tiles []Tile `json:"tiles"`
+	}
+	err := c.do("GET", "/tiles", nil, &res)
+	return res.Tiles, err
+}
+
+// Addresses returns the deposit address and balance of every tile, in
+// tile order.
+func (c *Client) Addresses() ([]Address, error) {
+	var res struct {
+		Addresses []Address `json:"addresses"`
+	}
+	err := c.do("GET", "/addresses", nil, &res)
+	return res.Addresses, err
+}
+
+// Lock reserves tile for a purchase. The tile is only ours when the
+// returned state is STATE_LOCKED_BY_CURRENT_USER.
+func (c *Client) Lock(tile int) (*LockResult, error) {
+	res := &LockResult{}
+	err := c.do("POST", "/tile", tileRequest{tile}, res)
+	return res, err
+}
+
+func (c *Client) Release(tile int) error {
+	return c.do("DELETE", "/tile", tileRequest{tile}, nil)
+}
+
+// Heartbeat extends the lock on tile, returning how long it now lasts.
+func (c *Client) Heartbeat(tile int) (time.Duration, error) {
+	var res struct {
+		TTL int64 `json:"ttl"`
+	}
+	err := c.do("POST", "/tile/heartbeat", tileRequest{tile}, &res)
+	return time.Duration(res.TTL) * time.Second, err
+}
+
+// Purchase buys a locked tile once its address holds the price, returning
+// the transaction id.
+func (c *Client) Purchase(tile int, message string) (string, error) {
+	var res struct {
+		TransactionId string `json:"transaction_id"`
+	}
+	err := c.do("POST", "/purchase", purchaseRequest{tile, message}, &res)
+	return res.TransactionId, err
+}
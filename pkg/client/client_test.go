@@ -0,0 +1,61 @@
+package client
+
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "testing"
+
+func TestClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer mdp_key" {
+			t.Errorf("got authorization %q", r.Header.Get("Authorization"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v1/tiles":
+			w.Write([]byte(`{"tiles":[{"message":"","state":"OPEN","ttl":-1,"price":0.001}]}`))
+		case "POST /api/v1/tile":
+			var req tileRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.FrameNumber != 3 {
+				t.Errorf("locked tile %d", req.FrameNumber)
+			}
+			w.Write([]byte(`{"state":"LOCKED_BY_CURRENT_USER","quote":{"price":0.002}}`))
+		case "POST /api/v1/purchase":
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":{"code":"invalid_request","message":"funds are insufficient"}}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	c := New(server.URL+"/", "mdp_key")
+
+	tiles, err := c.Tiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tiles) != 1 || tiles[0].State != STATE_OPEN || tiles[0].TTL != -1 {
+		t.Errorf("got tiles %+v", tiles)
+	}
+
+	lock, err := c.Lock(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock.State != STATE_LOCKED_BY_CURRENT_USER || lock.Quote == nil || lock.Quote.Price != 0.002 {
+		t.Errorf("got lock %+v", lock)
+	}
+
+	_, err = c.Purchase(3, "hello")
+	apiErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("got error %v", err)
+	}
+	if apiErr.Status != 400 || apiErr.Code != "invalid_request" || apiErr.Message != "funds are insufficient" {
+		t.Errorf("got error %+v", apiErr)
+	}
+}
@@ -0,0 +1,48 @@
+// Package network resolves the bitcoin network both the server and the
+// addressmonitor run on, and checks the btcd node agrees with it.
+package network
+
+import "errors"
+import "fmt"
+import "github.com/btcsuite/btcd/chaincfg"
+import "github.com/btcsuite/btcrpcclient"
+
+// Name resolves the db.btcd.network setting, honouring db.btcd.is_simnet
+// when no network is set.
+func Name(network string, isSimnet bool) string {
+	if network != "" {
+		return network
+	}
+	if isSimnet {
+		return "simnet"
+	}
+	return "mainnet"
+}
+
+// Params maps a network name to chain parameters.
+func Params(name string) (*chaincfg.Params, error) {
+	switch name {
+	case "mainnet":
+		return &chaincfg.MainNetParams, nil
+	case "testnet3":
+		return &chaincfg.TestNet3Params, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	case "simnet":
+		return &chaincfg.SimNetParams, nil
+	}
+	return nil, errors.New("Unknown network " + name)
+}
+
+// CheckNode fails when the btcd node runs on another network than the one
+// we derive addresses for.
+func CheckNode(rpc *btcrpcclient.Client, params *chaincfg.Params) error {
+	current, err := rpc.GetCurrentNet()
+	if err != nil {
+		return err
+	}
+	if current != params.Net {
+		return fmt.Errorf("btcd node is on %s but %s is configured", current, params.Name)
+	}
+	return nil
+}
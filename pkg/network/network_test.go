@@ -0,0 +1,31 @@
+package network
+
+import "testing"
+
+func TestParams(t *testing.T) {
+	for _, name := range []string{"mainnet", "testnet3", "regtest", "simnet"} {
+		params, err := Params(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params.Name != name {
+			t.Errorf("%s resolved to %s", name, params.Name)
+		}
+	}
+
+	if _, err := Params("testnet"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestName(t *testing.T) {
+	if name := Name("testnet3", true); name != "testnet3" {
+		t.Errorf("got %s, want the configured network", name)
+	}
+	if name := Name("", true); name != "simnet" {
+		t.Errorf("got %s, want simnet", name)
+	}
+	if name := Name("", false); name != "mainnet" {
+		t.Errorf("got %s, want mainnet", name)
+	}
+}
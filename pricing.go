@@ -0,0 +1,103 @@
+package main
+
+import "errors"
+import "strconv"
+import "github.com/btcsuite/btcutil"
+
+// PriceTier prices every tile in [From, To] inclusive.
+type PriceTier struct {
+	From  int     `mapstructure:"from"`
+	To    int     `mapstructure:"to"`
+	Price float64 `mapstructure:"price"`
+}
+
+// PremiumZone multiplies the price of a set of tiles.
+type PremiumZone struct {
+	Tiles      []int   `mapstructure:"tiles"`
+	Multiplier float64 `mapstructure:"multiplier"`
+}
+
+type PricingConfig struct {
+	Tiers     []PriceTier        `mapstructure:"tiers"`
+	Zones     []PremiumZone      `mapstructure:"zones"`
+	Overrides map[string]float64 `mapstructure:"overrides"`
+}
+
+// Pricer computes the price of a tile. An explicit override wins, otherwise
+// the first matching tier (or the base price) is multiplied by every premium
+// zone containing the tile.
+type Pricer struct {
+	Base      float64
+	Tiers     []PriceTier
+	Zones     []PremiumZone
+	Overrides map[int]float64
+}
+
+func NewPricer(base float64, config PricingConfig) (*Pricer, error) {
+	if base <= 0 {
+		return nil, errors.New("Base price must be positive")
+	}
+
+	overrides := make(map[int]float64, len(config.Overrides))
+	for key, price := range config.Overrides {
+		tile, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, errors.New("Price override for invalid tile " + key)
+		}
+		if price <= 0 {
+			return nil, errors.New("Price override for tile " + key + " must be positive")
+		}
+		overrides[tile] = price
+	}
+	for _, tier := range config.Tiers {
+		if tier.From > tier.To || tier.Price <= 0 {
+			return nil, errors.New("Invalid price tier")
+		}
+	}
+	for _, zone := range config.Zones {
+		if zone.Multiplier <= 0 {
+			return nil, errors.New("Premium zone multiplier must be positive")
+		}
+	}
+
+	return &Pricer{
+		Base:      base,
+		Tiers:     config.Tiers,
+		Zones:     config.Zones,
+		Overrides: overrides,
+	}, nil
+}
+
+func (p *Pricer) PriceForTile(tile int) float64 {
+	if price, ok := p.Overrides[tile]; ok {
+		return roundToSatoshis(price)
+	}
+
+	price := p.Base
+	for _, tier := range p.Tiers {
+		if tile >= tier.From && tile <= tier.To {
+			price = tier.Price
+			break
+		}
+	}
+
+	for _, zone := range p.Zones {
+		for _, zoneTile := range zone.Tiles {
+			if zoneTile == tile {
+				price *= zone.Multiplier
+				break
+			}
+		}
+	}
+	return roundToSatoshis(price)
+}
+
+// roundToSatoshis drops the fractions of a satoshi multipliers leave behind,
+// no wallet can pay them.
+func roundToSatoshis(price float64) float64 {
+	amount, err := btcutil.NewAmount(price)
+	if err != nil {
+		return price
+	}
+	return amount.ToBTC()
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestPricerRules(t *testing.T) {
+	pricer, err := NewPricer(0.01, PricingConfig{
+		Tiers: []PriceTier{
+			{From: 0, To: 3, Price: 0.05},
+		},
+		Zones: []PremiumZone{
+			{Tiles: []int{2, 8}, Multiplier: 2},
+		},
+		Overrides: map[string]float64{
+			"5": 1,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[int]float64{
+		0: 0.05,
+		2: 0.1,
+		5: 1,
+		7: 0.01,
+		8: 0.02,
+	}
+	for tile, price := range expected {
+		if res := pricer.PriceForTile(tile); res != price {
+			t.Errorf("tile %d: expected %f, got %f", tile, price, res)
+		}
+	}
+}
+
+func TestPricerRoundsToSatoshis(t *testing.T) {
+	pricer, err := NewPricer(0.001, PricingConfig{
+		Zones: []PremiumZone{
+			{Tiles: []int{1}, Multiplier: 1.23456789},
+		},
+		Overrides: map[string]float64{
+			"2": 0.123456789,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[int]float64{
+		0: 0.001,
+		1: 0.00123457,
+		2: 0.12345679,
+	}
+	for tile, price := range expected {
+		if res := pricer.PriceForTile(tile); res != price {
+			t.Errorf("tile %d: expected %.8f, got %v", tile, price, res)
+		}
+	}
+}
+
+func TestPricerRejectsInvalidRules(t *testing.T) {
+	_, err := NewPricer(0.01, PricingConfig{
+		Overrides: map[string]float64{"top": 1},
+	})
+	if err == nil {
+		t.Fail()
+	}
+
+	_, err = NewPricer(0.01, PricingConfig{
+		Tiers: []PriceTier{{From: 4, To: 1, Price: 1}},
+	})
+	if err == nil {
+		t.Fail()
+	}
+}
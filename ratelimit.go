@@ -0,0 +1,138 @@
+package main
+
+import "math"
+import "net"
+import "net/http"
+import "strconv"
+import "strings"
+import "time"
+import "gopkg.in/redis.v4"
+
+// Token bucket shared by every instance. KEYS is the bucket, ARGV the refill
+// rate in tokens per second, the burst and the current time in milliseconds.
+// Returns whether a token was taken and, if not, the milliseconds until one
+// is available.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(now - ts, 0) / 1000 * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000))
+return {allowed, wait}
+`)
+
+// RateLimit allows PerMinute requests on average with bursts of up to Burst.
+// A zero PerMinute disables the limit.
+type RateLimit struct {
+	PerMinute int `mapstructure:"per_minute"`
+	Burst     int `mapstructure:"burst"`
+}
+
+type RateLimitConfig struct {
+	Lock       RateLimit `mapstructure:"lock"`
+	Purchase   RateLimit `mapstructure:"purchase"`
+	Session    RateLimit `mapstructure:"session"`
+	Login      RateLimit `mapstructure:"login"`
+	TrustProxy bool      `mapstructure:"trust_proxy"`
+}
+
+type RateLimiter struct {
+	client *redis.Client
+	now    func() time.Time
+}
+
+func NewRateLimiter(client *redis.Client) *RateLimiter {
+	return &RateLimiter{
+		client: client,
+		now:    time.Now,
+	}
+}
+
+// Allow takes a token from the bucket named key, returning how long to wait
+// before retrying when the bucket is empty.
+func (rl *RateLimiter) Allow(key string, limit RateLimit) (bool, time.Duration, error) {
+	if limit.PerMinute <= 0 {
+		return true, 0, nil
+	}
+
+	res, err := tokenBucketScript.Run(
+		rl.client,
+		[]string{"ratelimit:" + key},
+		float64(limit.PerMinute)/60,
+		limit.Burst,
+		rl.now().UnixNano()/int64(time.Millisecond),
+	).Result()
+	if err != nil {
+		return true, 0, err
+	}
+
+	values := res.([]interface{})
+	allowed := values[0].(int64) == 1
+	wait := time.Duration(values[1].(int64)) * time.Millisecond
+	return allowed, wait, nil
+}
+
+// ClientIP returns the address of the client. Behind a trusted proxy it is
+// the last X-Forwarded-For hop, the one the proxy appended; earlier hops
+// come from the client and can be anything.
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			hops := strings.Split(forwarded, ",")
+			if hop := strings.TrimSpace(hops[len(hops)-1]); hop != "" {
+				return hop
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkRateLimit takes a token from every bucket in keys. When one is empty
+// it answers 429 with Retry-After and returns false. Redis errors let the
+// request through, limits are not worth an outage.
+func (s *Server) checkRateLimit(w http.ResponseWriter, r *http.Request, name string, limit RateLimit, keys ...string) bool {
+	for _, key := range keys {
+		allowed, wait, err := s.limiter.Allow(name+":"+key, limit)
+		if err != nil {
+			RequestLog(r).Errorln("Unable to check rate limit:", err)
+			continue
+		}
+		if !allowed {
+			rateLimited.WithLabelValues(name).Inc()
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			WriteJSON(w, RequestLog(r), 429, NewError(429, "rate limit exceeded, retry later").WithDetails(map[string]int{
+				"retry_after": retryAfter,
+			}))
+			return false
+		}
+	}
+	return true
+}
+
+// RateLimited limits fn per client IP and per session.
+func (s *Server) RateLimited(name string, limit RateLimit, fn func(http.ResponseWriter, *http.Request, *UserDetails)) func(http.ResponseWriter, *http.Request, *UserDetails) {
+	return func(w http.ResponseWriter, r *http.Request, details *UserDetails) {
+		ip := ClientIP(r, s.config.RateLimit.TrustProxy)
+		if !s.checkRateLimit(w, r, name, limit, "ip:"+ip, "session:"+details.SessionId.String()) {
+			return
+		}
+		fn(w, r, details)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "net/http/httptest"
+import "testing"
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("POST", "/tile", nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7")
+
+	if ip := ClientIP(r, false); ip != "10.0.0.1" {
+		t.Error("forwarded header trusted without a proxy:", ip)
+	}
+	if ip := ClientIP(r, true); ip != "203.0.113.7" {
+		t.Error("hop appended by the proxy not used:", ip)
+	}
+
+	// Clients can prepend whatever they like, only the last hop counts
+	r.Header.Set("X-Forwarded-For", "192.0.2.99, 203.0.113.7")
+	if ip := ClientIP(r, true); ip != "203.0.113.7" {
+		t.Error("spoofed forwarded hop used:", ip)
+	}
+}
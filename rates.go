@@ -0,0 +1,178 @@
+package main
+
+import "encoding/json"
+import "errors"
+import "io/ioutil"
+import "net/http"
+import "strings"
+import "sync"
+import "time"
+import "github.com/btcsuite/btcutil"
+
+// RateProvider returns the price of one bitcoin in a fiat currency.
+type RateProvider interface {
+	Rate(currency string) (float64, error)
+}
+
+// FileRateProvider reads rates from a JSON file mapping currency codes to
+// the price of one bitcoin, e.g. {"USD": 60000}. Meant for offline use.
+type FileRateProvider struct {
+	Path string
+}
+
+func (p *FileRateProvider) Rate(currency string) (float64, error) {
+	data, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	rates := make(map[string]float64)
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return 0, err
+	}
+	return validRate(rates[strings.ToUpper(currency)])
+}
+
+// HTTPRateProvider fetches a ticker in the blockchain.info format, e.g.
+// {"USD": {"last": 60000}}.
+type HTTPRateProvider struct {
+	URL    string
+	Client *http.Client
+}
+
+func (p *HTTPRateProvider) Rate(currency string) (float64, error) {
+	res, err := p.Client.Get(p.URL)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, errors.New("Rate provider returned " + res.Status)
+	}
+
+	ticker := make(map[string]struct {
+		Last float64 `json:"last"`
+	})
+	if err := json.NewDecoder(res.Body).Decode(&ticker); err != nil {
+		return 0, err
+	}
+	return validRate(ticker[strings.ToUpper(currency)].Last)
+}
+
+func validRate(rate float64) (float64, error) {
+	if rate <= 0 {
+		return 0, errors.New("No exchange rate for currency")
+	}
+	return rate, nil
+}
+
+type cachedRate struct {
+	rate      float64
+	fetchedAt time.Time
+}
+
+// CachedRateProvider refreshes rates every ttl. When the underlying provider
+// fails the last rate is still served until it is older than maxStaleness.
+type CachedRateProvider struct {
+	provider     RateProvider
+	ttl          time.Duration
+	maxStaleness time.Duration
+	now          func() time.Time
+	rates        map[string]cachedRate
+	lock         sync.Mutex
+}
+
+func NewCachedRateProvider(provider RateProvider, ttl time.Duration, maxStaleness time.Duration) *CachedRateProvider {
+	return &CachedRateProvider{
+		provider:     provider,
+		ttl:          ttl,
+		maxStaleness: maxStaleness,
+		now:          time.Now,
+		rates:        make(map[string]cachedRate),
+	}
+}
+
+func (p *CachedRateProvider) Rate(currency string) (float64, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	cached, ok := p.rates[currency]
+	age := p.now().Sub(cached.fetchedAt)
+	if ok && age < p.ttl {
+		return cached.rate, nil
+	}
+
+	rate, err := p.provider.Rate(currency)
+	if err != nil {
+		if ok && age < p.maxStaleness {
+			Log.Errorln("Unable to refresh exchange rate, using cached one:", err)
+			return cached.rate, nil
+		}
+		return 0, errors.New("Exchange rate is unavailable: " + err.Error())
+	}
+
+	p.rates[currency] = cachedRate{rate: rate, fetchedAt: p.now()}
+	return rate, nil
+}
+
+type PriceQuote struct {
+	Price     float64 `json:"price"`
+	FiatPrice float64 `json:"fiat_price,omitempty"`
+	Currency  string  `json:"currency,omitempty"`
+}
+
+// PriceQuoter turns tile prices into BTC amounts. Without a currency the
+// pricing rules are already in BTC, otherwise they are in fiat and get
+// converted at the current rate.
+type PriceQuoter struct {
+	pricer   *Pricer
+	rates    RateProvider
+	currency string
+}
+
+func NewPriceQuoter(pricer *Pricer, rates RateProvider, currency string) *PriceQuoter {
+	return &PriceQuoter{
+		pricer:   pricer,
+		rates:    rates,
+		currency: currency,
+	}
+}
+
+func (q *PriceQuoter) quote(price float64) (*PriceQuote, error) {
+	if q.currency == "" {
+		return &PriceQuote{Price: price}, nil
+	}
+
+	rate, err := q.rates.Rate(q.currency)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round to satoshis so the amount charged matches the amount shown
+	btcPrice, err := btcutil.NewAmount(price / rate)
+	if err != nil {
+		return nil, err
+	}
+	return &PriceQuote{
+		Price:     btcPrice.ToBTC(),
+		FiatPrice: price,
+		Currency:  q.currency,
+	}, nil
+}
+
+func (q *PriceQuoter) Base() (*PriceQuote, error) {
+	return q.quote(q.pricer.Base)
+}
+
+func (q *PriceQuoter) Quote(tile int) (*PriceQuote, error) {
+	return q.quote(q.pricer.PriceForTile(tile))
+}
+
+// PriceForTile returns the BTC price of a tile.
+func (q *PriceQuoter) PriceForTile(tile int) (float64, error) {
+	quote, err := q.Quote(tile)
+	if err != nil {
+		return 0, err
+	}
+	return quote.Price, nil
+}
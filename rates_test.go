@@ -0,0 +1,64 @@
+package main
+
+import "errors"
+import "io/ioutil"
+import "os"
+import "testing"
+import "time"
+
+type fakeRateProvider struct {
+	rate float64
+	err  error
+}
+
+func (p *fakeRateProvider) Rate(currency string) (float64, error) {
+	return p.rate, p.err
+}
+
+func TestCachedRateProviderStaleness(t *testing.T) {
+	now := time.Now()
+	provider := &fakeRateProvider{rate: 50000}
+	cached := NewCachedRateProvider(provider, time.Minute, time.Hour)
+	cached.now = func() time.Time { return now }
+
+	if rate, err := cached.Rate("USD"); err != nil || rate != 50000 {
+		t.Fatal(rate, err)
+	}
+
+	// Served from cache within the TTL
+	provider.rate = 60000
+	if rate, _ := cached.Rate("USD"); rate != 50000 {
+		t.Fail()
+	}
+
+	// Provider down, cached rate still fresh enough
+	provider.err = errors.New("down")
+	now = now.Add(time.Minute * 30)
+	if rate, err := cached.Rate("USD"); err != nil || rate != 50000 {
+		t.Fail()
+	}
+
+	// Past the staleness limit
+	now = now.Add(time.Hour)
+	if _, err := cached.Rate("USD"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestFileRateProvider(t *testing.T) {
+	file, err := ioutil.TempFile("", "rates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"USD": 40000}`)
+	file.Close()
+
+	provider := &FileRateProvider{Path: file.Name()}
+	if rate, err := provider.Rate("usd"); err != nil || rate != 40000 {
+		t.Fail()
+	}
+	if _, err := provider.Rate("EUR"); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import "bytes"
+import "crypto/aes"
+import "crypto/cipher"
+import "crypto/rand"
+import "encoding/hex"
+import "errors"
+import "io"
+import "io/ioutil"
+import "strings"
+import "gopkg.in/redis.v4"
+
+// Prefix marking a seed encrypted at rest. Values without it are legacy
+// plain text seeds and are re-encrypted by the reencrypt-seeds command.
+const SEED_CIPHER_PREFIX = "enc1:"
+
+// SeedCipher encrypts session master seeds with AES-GCM. The first key is
+// used for encryption, every key is tried for decryption so old keys can
+// still be read while rotating.
+type SeedCipher struct {
+	aeads []cipher.AEAD
+}
+
+func NewSeedCipher(keys ...[]byte) (*SeedCipher, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("At least one seed encryption key is required")
+	}
+
+	aeads := make([]cipher.AEAD, len(keys))
+	for i, key := range keys {
+		if len(key) != 32 {
+			return nil, errors.New("Seed encryption keys must be 32 bytes")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aeads[i], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &SeedCipher{aeads: aeads}, nil
+}
+
+// LoadSeedKey reads a hex encoded 32 byte key, either given inline or from
+// a key file. The inline key wins when both are set.
+func LoadSeedKey(hexKey string, keyFile string) ([]byte, error) {
+	if hexKey == "" && keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		hexKey = string(data)
+	}
+	if hexKey == "" {
+		return nil, errors.New("No seed encryption key configured")
+	}
+	return hex.DecodeString(strings.TrimSpace(hexKey))
+}
+
+// Encrypt seals a seed, binding it to the redis key it is stored under so
+// ciphertexts cannot be swapped between sessions.
+func (c *SeedCipher) Encrypt(seed []byte, storageKey string) ([]byte, error) {
+	aead := c.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	res := append([]byte(SEED_CIPHER_PREFIX), nonce...)
+	return aead.Seal(res, nonce, seed, []byte(storageKey)), nil
+}
+
+// Decrypt opens a stored seed. Legacy plain text values are returned as is
+// with encrypted set to false.
+func (c *SeedCipher) Decrypt(data []byte, storageKey string) (seed []byte, encrypted bool, err error) {
+	if !bytes.HasPrefix(data, []byte(SEED_CIPHER_PREFIX)) {
+		return data, false, nil
+	}
+	data = data[len(SEED_CIPHER_PREFIX):]
+
+	for _, aead := range c.aeads {
+		if len(data) < aead.NonceSize() {
+			return nil, true, errors.New("Encrypted seed is truncated")
+		}
+		nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+		seed, err = aead.Open(nil, nonce, sealed, []byte(storageKey))
+		if err == nil {
+			return seed, true, nil
+		}
+	}
+	return nil, true, errors.New("Unable to decrypt seed with any configured key")
+}
+
+// ReencryptSeeds rewrites every stored session seed with the current key,
+// keeping its TTL. It returns the number of seeds rewritten.
+func ReencryptSeeds(client *redis.Client, seeds *SeedCipher) (int, error) {
+	var cursor uint64
+	count := 0
+	for {
+		keys, next, err := client.Scan(cursor, "session:*", 100).Result()
+		if err != nil {
+			return count, err
+		}
+
+		for _, key := range keys {
+			val, err := client.Get(key).Result()
+			if err == redis.Nil {
+				continue
+			} else if err != nil {
+				return count, err
+			}
+
+			seed, _, err := seeds.Decrypt([]byte(val), key)
+			if err != nil {
+				return count, err
+			}
+			encrypted, err := seeds.Encrypt(seed, key)
+			if err != nil {
+				return count, err
+			}
+
+			ttl, err := client.TTL(key).Result()
+			if err != nil {
+				return count, err
+			}
+			if ttl < 0 {
+				ttl = SESSION_LIFE
+			}
+			if err := client.Set(key, encrypted, ttl).Err(); err != nil {
+				return count, err
+			}
+			count++
+		}
+
+		if next == 0 {
+			return count, nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "bytes"
+import "testing"
+
+func TestSeedCipherRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	seeds, err := NewSeedCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := []byte("0123456789abcdef0123456789abcdef")
+	encrypted, err := seeds.Encrypt(seed, "session:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, seed) {
+		t.Fail()
+	}
+
+	res, wasEncrypted, err := seeds.Decrypt(encrypted, "session:a")
+	if err != nil || !wasEncrypted || !bytes.Equal(res, seed) {
+		t.Fail()
+	}
+
+	// Ciphertexts are bound to their session
+	if _, _, err := seeds.Decrypt(encrypted, "session:b"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestSeedCipherRotation(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	oldSeeds, _ := NewSeedCipher(oldKey)
+	rotated, _ := NewSeedCipher(newKey, oldKey)
+
+	seed := []byte("seed")
+	encrypted, _ := oldSeeds.Encrypt(seed, "session:a")
+	res, _, err := rotated.Decrypt(encrypted, "session:a")
+	if err != nil || !bytes.Equal(res, seed) {
+		t.Fail()
+	}
+
+	// Legacy plain text seeds are passed through
+	res, wasEncrypted, err := rotated.Decrypt(seed, "session:a")
+	if err != nil || wasEncrypted || !bytes.Equal(res, seed) {
+		t.Fail()
+	}
+}
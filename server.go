@@ -0,0 +1,94 @@
+package main
+
+import "context"
+import "net/http"
+import "os"
+import "os/signal"
+import "sync/atomic"
+import "syscall"
+import "time"
+
+// HTTPServer builds the http.Server described by the server section of the
+// configuration.
+func (s *Server) HTTPServer(handler http.Handler) *http.Server {
+	c := s.config.Server
+	return &http.Server{
+		Addr:         c.Listen,
+		Handler:      handler,
+		ReadTimeout:  time.Duration(c.ReadTimeoutSecs) * time.Second,
+		WriteTimeout: time.Duration(c.WriteTimeoutSecs) * time.Second,
+		IdleTimeout:  time.Duration(c.IdleTimeoutSecs) * time.Second,
+	}
+}
+
+// runEvery calls job every interval, forever, logging the errors it returns
+// so the next run can retry.
+func runEvery(interval time.Duration, job func() error) {
+	for {
+		if err := job(); err != nil {
+			Log.Errorln(err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Draining reports whether a shutdown has started. New locks are refused
+// from then on so no purchase starts that could not finish.
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Serve listens until SIGINT or SIGTERM, then drains in-flight requests and
+// background purchases before closing Redis, Postgres and btcd.
+func (s *Server) Serve(handler http.Handler) error {
+	server := s.HTTPServer(handler)
+
+	errs := make(chan error, 1)
+	go func() {
+		if s.config.Server.TLSCert != "" {
+			Log.Infoln("Listening with TLS on", server.Addr)
+			errs <- server.ListenAndServeTLS(s.config.Server.TLSCert, s.config.Server.TLSKey)
+		} else {
+			Log.Infoln("Listening on", server.Addr)
+			errs <- server.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		Log.Infoln("Received", sig, "shutting down")
+	}
+
+	atomic.StoreInt32(&s.draining, 1)
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		time.Duration(s.config.Server.ShutdownTimeoutSecs)*time.Second,
+	)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		Log.Errorln("Unable to drain all requests:", err)
+	}
+
+	// Watchers purchase under this lock, holding it keeps them from starting
+	// another purchase while the connections are closed.
+	s.tiles.PurchaseLock.Lock()
+	s.Close()
+	return err
+}
+
+// Close releases the Redis, Postgres and btcd connections.
+func (s *Server) Close() {
+	if err := s.redis.Close(); err != nil {
+		Log.Errorln(err)
+	}
+	if err := s.dbs.Close(); err != nil {
+		Log.Errorln(err)
+	}
+	s.rpc.Shutdown()
+	s.rpc.WaitForShutdown()
+}
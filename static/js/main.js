@@ -1,3 +1,17 @@
+var API = "/api/v1";
+
+// State changing requests must echo the CSRF cookie in a header
+$.ajaxSetup({
+    beforeSend: function(xhr, settings) {
+        if (!/^(GET|HEAD|OPTIONS)$/i.test(settings.type)) {
+            var match = document.cookie.match(/(?:^|; )csrf_token=([^;]*)/);
+            if (match) {
+                xhr.setRequestHeader("X-CSRF-Token", decodeURIComponent(match[1]));
+            }
+        }
+    }
+});
+
 var Timer = React.createClass({
     getInitialState: function() {
         return {
@@ -57,24 +71,64 @@ var Tile = React.createClass({
         "LOCKED_BY_CURRENT_USER": "Locked by current user",
         "LOCKED_BY_OTHER": "Locked by other",
         "PURCHASED": "Purchased",
+        "PURCHASED_BY_CURRENT_USER": "Purchased by you",
         "OPEN": "Open"
     },
     onArrowClicked: function() {
         this.setState({message: this.state.currentMessage});
         this.props.onArrowClicked(this.props.idx);
     },
+    checkInvoice: function() {
+        var self = this;
+        if (!this.state.invoice) {
+            // The invoice extends the lock, no heartbeat is needed after it
+            if (!this.state.invoiceRequested) {
+                this.setState({invoiceRequested: true});
+                $.post(API + "/invoice", JSON.stringify({
+                    "frame_number": this.props.idx,
+                    "message": this.state.message,
+                })).done(function(res) {
+                    self.setState({invoice: res});
+                }).fail(function() {
+                    self.setState({invoiceRequested: false});
+                });
+            }
+            return;
+        }
+        $.getJSON(API + "/invoice/" + this.state.invoice.address, function(res) {
+            self.setState({invoice: res});
+        });
+    },
     checkAndPurchaseTile: function() {
+        if (this.props.invoiceMode) {
+            this.checkInvoice();
+            return;
+        }
+
         var isCorrectTile = this.props.dataState == 'LOCKED_BY_CURRENT_USER';
         var balanceSuccessful = this.props.balance >= this.props.price;
         if (isCorrectTile && balanceSuccessful) {
-            $.post("/purchase", JSON.stringify({
+            $.post(API + "/purchase", JSON.stringify({
                 "frame_number": this.props.idx,
                 "message": this.state.message,
             }), function(res) {
                 self.reloadAddresses();
             });
+        } else if (isCorrectTile) {
+            // Keep the lock while waiting for funds
+            var now = Date.now();
+            if (!this.state.lastHeartbeat || now - this.state.lastHeartbeat > 30000) {
+                this.setState({lastHeartbeat: now});
+                $.post(API + "/tile/heartbeat", JSON.stringify({
+                    "frame_number": this.props.idx
+                }));
+            }
         }
     },
+    onCancelClicked: function() {
+        this.setState({message: "", invoice: null, invoiceRequested: false});
+        this.props.onCancelClicked(this.props.idx);
+    },
     componentWillReceiveProps: function(nextProps) {
         if (nextProps.dataState == 'LOCKED_BY_CURRENT_USER' && this.state.message.length > 0) {
             if (!this.state.timer) {
@@ -86,7 +140,7 @@ var Tile = React.createClass({
         } else {
             if (this.state.timer) {
                 clearInterval(this.state.timer);
-                this.setState({timer: null});
+                this.setState({timer: null, invoice: null, invoiceRequested: false});
                 console.log("Deleted timer for tile " + this.props.idx)
             }
         }
@@ -108,9 +162,45 @@ var Tile = React.createClass({
             </div>
         );
     },
+    renderInvoice: function() {
+        var invoice = this.state.invoice;
+        if (!invoice) {
+            return (
+                <div className="body text-center">
+                   <h3>CREATING INVOICE</h3>
+                </div>
+            );
+        }
+        if (invoice.status != 'PENDING') {
+            return (
+                <div className="body text-center">
+                   <h3>INVOICE {invoice.status.replace(/_/g, ' ')}</h3>
+                </div>
+            );
+        }
+        var uri = "bitcoin:" + invoice.address + "?amount=" + invoice.amount;
+        return (
+            <div className="body text-center">
+               <h3>PAY {invoice.amount} BTC</h3>
+               <a href={uri}>{invoice.address}</a>
+            </div>
+        );
+    },
     renderLockedByCurrentUser: function() {
+        if (this.props.invoiceMode) {
+            return (
+                <div className="tile">
+                    <div className="header text-center">
+                       LOCKED FOR <Timer secs={this.props.ttl} />
+                    </div>
+                    {this.renderInvoice()}
+                </div>
+            );
+        }
+
         var nextBtnClasses = "next-btn glyphicon glyphicon-play";
-        var qrCode = "https://chart.googleapis.com/chart?chs=95x95&cht=qr&chl=" + this.props.address;
+        // A BIP21 code carrying the amount still needed
+        var qrCode = API + "/addresses/" + this.props.idx + "/qr";
         if (this.balance == 0) {
             nextBtnClasses += ' hide-text';
         }
@@ -121,7 +211,8 @@ var Tile = React.createClass({
                 </div>
                 <div className="body text-center">
                    <h3>SCAN QR CODE</h3>
-                   <img className="center-block" src={qrCode} />
+                   <img className="center-block" src={qrCode} width="95" height="95" />
+                   <a className="cancel-lock" onClick={this.onCancelClicked}>Cancel</a>
                 </div>
             </div>
         );
@@ -151,7 +242,7 @@ var Tile = React.createClass({
         );
     },
     render: function() {
-        if (this.props.dataState == 'PURCHASED') {
+        if (this.props.dataState == 'PURCHASED' || this.props.dataState == 'PURCHASED_BY_CURRENT_USER') {
             return this.renderPurchased();
         }
 
@@ -169,17 +260,30 @@ var Tile = React.createClass({
 
 var MainComponent = React.createClass({
   getInitialState: function() {
-      return { addresses: [], tiles: [], balance: null };
+      return { addresses: [], tiles: [], quotes: {}, balance: null, invoiceMode: false };
   },
   reloadAddresses: function() {
       var self = this;
-      var addressesRequest = $.getJSON('/addresses');
-      var tilesRequest = $.getJSON('/tiles');
+      if (this.state.invoiceMode) {
+          $.getJSON(API + '/tiles').then(function(res) {
+              self.setState({tiles: res.tiles});
+          });
+          return;
+      }
+
+      var addressesRequest = $.getJSON(API + '/addresses');
+      var tilesRequest = $.getJSON(API + '/tiles');
       $.when(addressesRequest, tilesRequest).then(function(a, b) {
           self.setState({
-              addresses: a[0],
-              tiles: b[0],
+              addresses: a[0].addresses,
+              tiles: b[0].tiles,
           });
+      }, function(xhr) {
+          // Servers in invoice mode have no per session addresses
+          if (xhr.status == 404) {
+              self.setState({invoiceMode: true});
+              self.reloadAddresses();
+          }
       });
   },
   componentDidMount: function() {
@@ -188,31 +292,48 @@ var MainComponent = React.createClass({
       setInterval(function() {
           self.reloadAddresses();
       }, 3000);
-
-      $.getJSON('/price').then(function(res) {
-          self.setState({'price': res.price});
-      });
   },
   lockTable: function(idx) {
       var self = this;
-      $.post("/tile", JSON.stringify({
+      $.post(API + "/tile", JSON.stringify({
           "frame_number": idx
       }), function(res) {
+          // The purchase is charged at the price quoted with the lock
+          if (res.quote) {
+              var quotes = $.extend({}, self.state.quotes);
+              quotes[idx] = res.quote.price;
+              self.setState({quotes: quotes});
+          }
+          self.reloadAddresses();
+      });
+  },
+  releaseTable: function(idx) {
+      var self = this;
+      $.ajax({
+          url: API + "/tile",
+          type: "DELETE",
+          data: JSON.stringify({
+              "frame_number": idx
+          })
+      }).always(function() {
           self.reloadAddresses();
       });
   },
   render: function() {
     var tiles = [];
-    for (var i=0; i < this.state.addresses.length; i++) {
-        var balance = this.state.addresses[i].balance;
-        var address = this.state.addresses[i].address;
+    for (var i=0; i < this.state.tiles.length; i++) {
+        var addressData = this.state.addresses[i] || {};
+        var balance = addressData.balance;
+        var address = addressData.address;
         var tileData = this.state.tiles[i];
         var tile = (
             <div key={i} className="col-md-2 col-sm-2">
                 <Tile
-                 price={this.state.price}
+                 price={i in this.state.quotes ? this.state.quotes[i] : tileData.price}
                  idx={i}
+                 invoiceMode={this.state.invoiceMode}
                  onArrowClicked={this.lockTable}
+                 onCancelClicked={this.releaseTable}
                  dataState={tileData.state}
                  ttl={tileData.ttl}
                  address={address}
@@ -1,5 +1,6 @@
 package main
 
+import "encoding/json"
 import "gopkg.in/redis.v4"
 import "sync"
 import "strconv"
@@ -12,19 +13,93 @@ const (
 	STATE_OPEN                   = "OPEN"
 	STATE_LOCKED_BY_CURRENT_USER = "LOCKED_BY_CURRENT_USER"
 	STATE_PURCHASED              = "PURCHASED"
+	STATE_PURCHASED_BY_CURRENT   = "PURCHASED_BY_CURRENT_USER"
 )
 
+// Extends a purchased tile (or revives it during the priority window) when
+// called by its owner. KEYS are tile, body and owner, ARGV the owner, the
+// extension and the priority window, both in milliseconds.
+var renewTileScript = redis.NewScript(`
+if redis.call('HGET', KEYS[3], 'session') ~= ARGV[1] then
+	return -1
+end
+local ttl = 0
+if redis.call('GET', KEYS[1]) == 'PURCHASED' then
+	ttl = math.max(redis.call('PTTL', KEYS[1]), 0)
+end
+local newTTL = ttl + tonumber(ARGV[2])
+redis.call('SET', KEYS[1], 'PURCHASED', 'PX', newTTL)
+redis.call('PEXPIRE', KEYS[2], newTTL + tonumber(ARGV[3]))
+redis.call('PEXPIRE', KEYS[3], newTTL + tonumber(ARGV[3]))
+return newTTL
+`)
+
+// Replaces the body of a running ad, keeping its expiry, when called by its
+// owner. KEYS are tile, body and owner, ARGV the owner and the new body.
+var editTileScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= 'PURCHASED' then
+	return -2
+end
+if redis.call('HGET', KEYS[3], 'session') ~= ARGV[1] then
+	return -1
+end
+redis.call('SET', KEYS[2], ARGV[2], 'PX', redis.call('PTTL', KEYS[2]))
+return 1
+`)
+
+// Deletes a lock, and the price quoted with it, as long as it is still held
+// by the session in ARGV. KEYS are tile and quote.
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1], KEYS[2])
+return 1
+`)
+
+// Sets the expiry of a lock and its quote to ARGV[2] milliseconds as long as
+// it is still held by the session in ARGV[1]. KEYS are tile and quote.
+var extendLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return 1
+`)
+
+// ErrLockLimit is returned by Lock when the session already holds as many
+// locks as allowed.
+var ErrLockLimit = errors.New("This session holds too many locks")
+var ErrNoQuote = errors.New("No price was quoted for this lock")
+
+// TileOwner records who bought the ad running on a tile and which purchase
+// (transaction or invoice) paid for it.
+type TileOwner struct {
+	SessionId  uuid.UUID `json:"-"`
+	PurchaseId string    `json:"purchase_id"`
+}
+
+// TileManager keeps tile locks and purchases in Redis. A session holds at
+// most MaxLocks locks at once, and heartbeats keep a lock for at most
+// MaxLockHold after it was taken. Zero disables either limit.
 type TileManager struct {
-	NumTiles     int
-	Client       *redis.Client
-	lock         sync.Mutex
-	PurchaseLock sync.Mutex
+	NumTiles      int
+	Client        *redis.Client
+	RenewPriority time.Duration
+	MaxLocks      int
+	MaxLockHold   time.Duration
+	lock          sync.Mutex
+	PurchaseLock  sync.Mutex
 }
 
-func NewTileManager(numTiles int, client *redis.Client) *TileManager {
+func NewTileManager(numTiles int, client *redis.Client, renewPriority time.Duration, maxLocks int, maxLockHold time.Duration) *TileManager {
 	return &TileManager{
-		NumTiles: numTiles,
-		Client:   client,
+		NumTiles:      numTiles,
+		Client:        client,
+		RenewPriority: renewPriority,
+		MaxLocks:      maxLocks,
+		MaxLockHold:   maxLockHold,
 	}
 }
 
@@ -32,33 +107,149 @@ func (tm *TileManager) KeyForBody(tile int) string {
 	return "body:" + strconv.Itoa(tile)
 }
 
-func (tm *TileManager) PurchaseTile(tile int, body string, duration time.Duration) error {
+func (tm *TileManager) keyForOwner(tile int) string {
+	return "owner:" + strconv.Itoa(tile)
+}
+
+// Owner returns the owner of a tile, for as long as the ad runs plus the
+// renewal priority window.
+func (tm *TileManager) Owner(tile int) (*TileOwner, error) {
+	fields, err := tm.Client.HGetAll(tm.keyForOwner(tile)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("This tile has no owner")
+	}
+
+	session, err := uuid.FromString(fields["session"])
+	if err != nil {
+		return nil, err
+	}
+	return &TileOwner{
+		SessionId:  session,
+		PurchaseId: fields["purchase_id"],
+	}, nil
+}
+
+// ownerSession returns the owner session of a tile, or an empty string.
+func (tm *TileManager) ownerSession(tile int) string {
+	session, _ := tm.Client.HGet(tm.keyForOwner(tile), "session").Result()
+	return session
+}
+
+// ValidateMessage checks an ad body before it is published, both on
+// purchase and when the owner edits it.
+func ValidateMessage(body string) error {
 	if len(body) == 0 {
 		return errors.New("Body is empty, impossible to set")
 	}
+	return nil
+}
+
+// EditTile replaces the message of a running ad owned by owner.
+func (tm *TileManager) EditTile(tile int, body string, owner uuid.UUID) error {
+	if err := ValidateMessage(body); err != nil {
+		return err
+	}
+
+	if tile < 0 || tile >= tm.NumTiles {
+		return errors.New("This tile is not available")
+	}
+
+	res, err := editTileScript.Run(
+		tm.Client,
+		[]string{tm.keyForTile(tile), tm.KeyForBody(tile), tm.keyForOwner(tile)},
+		owner.String(),
+		body,
+	).Result()
+	if err != nil {
+		return err
+	}
+
+	switch code, _ := res.(int64); code {
+	case -2:
+		return errors.New("Tile is not purchased")
+	case -1:
+		return errors.New("Tile is not owned by this user")
+	}
+	return nil
+}
+
+// RenewTile extends the ad of owner by duration, either while it runs or
+// during the priority window after it expired. It returns the new TTL.
+func (tm *TileManager) RenewTile(tile int, duration time.Duration, owner uuid.UUID) (time.Duration, error) {
+	if tile < 0 || tile >= tm.NumTiles {
+		return 0, errors.New("This tile is not available")
+	}
+
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	res, err := renewTileScript.Run(
+		tm.Client,
+		[]string{tm.keyForTile(tile), tm.KeyForBody(tile), tm.keyForOwner(tile)},
+		owner.String(),
+		int64(duration/time.Millisecond),
+		int64(tm.RenewPriority/time.Millisecond),
+	).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	ttl, _ := res.(int64)
+	if ttl < 0 {
+		return 0, errors.New("Tile is not owned by this user")
+	}
+	return time.Duration(ttl) * time.Millisecond, nil
+}
+
+func (tm *TileManager) PurchaseTile(tile int, body string, duration time.Duration, owner uuid.UUID, purchaseId string) error {
+	if err := ValidateMessage(body); err != nil {
+		return err
+	}
 
 	if tile >= tm.NumTiles {
 		return errors.New("This tile is not available")
 	}
 
+	start := time.Now()
 	_, err := tm.Client.Set(
 		tm.keyForTile(tile), "PURCHASED", duration,
 	).Result()
+	ObserveCall("redis", "purchase", start, err)
 	if err != nil {
 		return err
 	}
+	tm.Client.Del(tm.keyForQuote(tile))
 
+	// Body and owner outlive the ad by the priority window so the owner
+	// can still renew it
 	_, err = tm.Client.Set(
-		tm.KeyForBody(tile), body, duration,
+		tm.KeyForBody(tile), body, duration+tm.RenewPriority,
 	).Result()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	_, err = tm.Client.HMSet(tm.keyForOwner(tile), map[string]string{
+		"session":     owner.String(),
+		"purchase_id": purchaseId,
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	return tm.Client.Expire(tm.keyForOwner(tile), duration+tm.RenewPriority).Err()
 }
 
-func (tm *TileManager) Lock(tile int, duration time.Duration, locker uuid.UUID) (error, string) {
+func (tm *TileManager) keyForQuote(tile int) string {
+	return "quote:" + strconv.Itoa(tile)
+}
+
+// Lock locks a tile for locker, recording the price quoted at lock time so
+// it is honoured for as long as the lock holds.
+func (tm *TileManager) Lock(tile int, duration time.Duration, locker uuid.UUID, quote *PriceQuote) (error, string) {
 	if tile >= tm.NumTiles {
 		return errors.New("This tile is not available"), ""
 	}
@@ -66,19 +257,58 @@ func (tm *TileManager) Lock(tile int, duration time.Duration, locker uuid.UUID)
 	tm.lock.Lock()
 	defer tm.lock.Unlock()
 
+	// During the renewal priority window only the previous owner may lock
+	if owner := tm.ownerSession(tile); owner != "" && owner != locker.String() {
+		if val, _ := tm.Client.Get(tm.keyForTile(tile)).Result(); val == "PURCHASED" {
+			return nil, STATE_PURCHASED
+		}
+		return nil, STATE_LOCKED_BY_OTHER
+	}
+
+	start := time.Now()
+	held, err := tm.heldLocks(locker)
+	if err != nil {
+		return err, ""
+	}
+	if _, ok := held[tile]; !ok && tm.MaxLocks > 0 && len(held) >= tm.MaxLocks {
+		return ErrLockLimit, ""
+	}
+
 	val, err := tm.Client.SetNX(
 		tm.keyForTile(tile), locker.String(), duration,
 	).Result()
+	ObserveCall("redis", "lock", start, err)
 	if err != nil && err != redis.Nil {
 		return err, ""
 	}
 
 	if val == true {
+		data, err := json.Marshal(quote)
+		if err != nil {
+			return err, ""
+		}
+		err = tm.Client.Set(tm.keyForQuote(tile), data, duration).Err()
+		if err != nil {
+			return err, ""
+		}
+
+		// Remember when the lock was taken, for caps and heartbeats
+		locksKey := tm.keyForSessionLocks(locker)
+		err = tm.Client.ZAdd(locksKey, redis.Z{
+			Score:  float64(time.Now().UnixNano() / int64(time.Millisecond)),
+			Member: strconv.Itoa(tile),
+		}).Err()
+		if err != nil {
+			return err, ""
+		}
+		tm.Client.Expire(locksKey, SESSION_LIFE)
 		return nil, STATE_LOCKED_BY_CURRENT_USER
 	} else {
 		val2, _ := tm.Client.Get(tm.keyForTile(tile)).Result()
 		if val2 == "" {
 			return nil, STATE_OPEN
+		} else if val2 == locker.String() {
+			return nil, STATE_LOCKED_BY_CURRENT_USER
 		} else if val2 == "PURCHASED" {
 			return nil, STATE_PURCHASED
 		} else {
@@ -87,6 +317,150 @@ func (tm *TileManager) Lock(tile int, duration time.Duration, locker uuid.UUID)
 	}
 }
 
+func (tm *TileManager) keyForSessionLocks(locker uuid.UUID) string {
+	return "locks:" + locker.String()
+}
+
+// heldLocks returns the tiles locked by locker with the time each lock was
+// taken, forgetting locks that expired, were released or got purchased.
+func (tm *TileManager) heldLocks(locker uuid.UUID) (map[int]time.Time, error) {
+	locksKey := tm.keyForSessionLocks(locker)
+	entries, err := tm.Client.ZRangeWithScores(locksKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	held := make(map[int]time.Time)
+	for _, entry := range entries {
+		member, _ := entry.Member.(string)
+		tile, err := strconv.Atoi(member)
+		if err != nil {
+			tm.Client.ZRem(locksKey, entry.Member)
+			continue
+		}
+		if val, _ := tm.Client.Get(tm.keyForTile(tile)).Result(); val != locker.String() {
+			tm.Client.ZRem(locksKey, member)
+			continue
+		}
+		held[tile] = time.Unix(0, int64(entry.Score)*int64(time.Millisecond))
+	}
+	return held, nil
+}
+
+// Release gives up a lock held by locker before it expires.
+func (tm *TileManager) Release(tile int, locker uuid.UUID) error {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	res, err := releaseLockScript.Run(
+		tm.Client,
+		[]string{tm.keyForTile(tile), tm.keyForQuote(tile)},
+		locker.String(),
+	).Result()
+	if err != nil {
+		return err
+	}
+	if released, _ := res.(int64); released == 0 {
+		return errors.New("Tile is not locked by this user")
+	}
+	return tm.Client.ZRem(tm.keyForSessionLocks(locker), strconv.Itoa(tile)).Err()
+}
+
+// Heartbeat extends a lock held by locker to duration from now, without
+// keeping it past MaxLockHold after it was taken. Returns the time left.
+func (tm *TileManager) Heartbeat(tile int, duration time.Duration, locker uuid.UUID) (time.Duration, error) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	held, err := tm.heldLocks(locker)
+	if err != nil {
+		return 0, err
+	}
+	lockedAt, ok := held[tile]
+	if !ok {
+		return 0, errors.New("Tile is not locked by this user")
+	}
+
+	now := time.Now()
+	expiry := now.Add(duration)
+	if tm.MaxLockHold > 0 && expiry.After(lockedAt.Add(tm.MaxLockHold)) {
+		expiry = lockedAt.Add(tm.MaxLockHold)
+	}
+
+	// Never shorten a lock, e.g. one extended for an invoice
+	ttl, err := tm.Client.PTTL(tm.keyForTile(tile)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if now.Add(ttl).After(expiry) {
+		return ttl, nil
+	}
+	if !expiry.After(now) {
+		return 0, errors.New("Lock cannot be extended any further")
+	}
+
+	ttl = expiry.Sub(now)
+	res, err := extendLockScript.Run(
+		tm.Client,
+		[]string{tm.keyForTile(tile), tm.keyForQuote(tile)},
+		locker.String(),
+		int64(ttl/time.Millisecond),
+	).Result()
+	if err != nil {
+		return 0, err
+	}
+	if extended, _ := res.(int64); extended == 0 {
+		return 0, errors.New("Tile is not locked by this user")
+	}
+	return ttl, nil
+}
+
+// ExtendLock pushes back the expiry of a lock held by locker.
+func (tm *TileManager) ExtendLock(tile int, duration time.Duration, locker uuid.UUID) error {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	val, err := tm.Client.Get(tm.keyForTile(tile)).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if val != locker.String() {
+		return errors.New("Tile is not locked by this user")
+	}
+	if err := tm.Client.Expire(tm.keyForQuote(tile), duration).Err(); err != nil {
+		return err
+	}
+	return tm.Client.Expire(tm.keyForTile(tile), duration).Err()
+}
+
+// LockedQuote returns the price quoted when locker locked the tile, as long
+// as the lock is still held.
+func (tm *TileManager) LockedQuote(tile int, locker uuid.UUID) (*PriceQuote, error) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	val, err := tm.Client.Get(tm.keyForTile(tile)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if val != locker.String() {
+		return nil, errors.New("Tile is not locked by this user")
+	}
+
+	data, err := tm.Client.Get(tm.keyForQuote(tile)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNoQuote
+	} else if err != nil {
+		return nil, err
+	}
+
+	quote := &PriceQuote{}
+	if err := json.Unmarshal(data, quote); err != nil {
+		return nil, err
+	}
+	return quote, nil
+}
+
 func (tm *TileManager) keyForTile(tile int) string {
 	return "tile:" + strconv.Itoa(tile)
 }
@@ -110,29 +484,40 @@ func (tm *TileManager) CanPurchase(tile int, locker uuid.UUID) (bool, error) {
 	}
 }
 
-func (tm *TileManager) GetState(locker uuid.UUID) []string {
+func (tm *TileManager) GetState(locker uuid.UUID) ([]string, error) {
 	tm.lock.Lock()
 	defer tm.lock.Unlock()
 
 	result := make([]string, tm.NumTiles)
 	for i := 0; i < tm.NumTiles; i++ {
+		start := time.Now()
 		val, err := tm.Client.Get(tm.keyForTile(i)).Result()
+		ObserveCall("redis", "state", start, err)
 
 		if err == redis.Nil {
 			result[i] = STATE_OPEN
 		} else if err != nil {
-			Error.Fatal(err)
+			return nil, err
 		}
 
 		if val == locker.String() {
 			result[i] = STATE_LOCKED_BY_CURRENT_USER
 		} else if val == "PURCHASED" {
 			result[i] = STATE_PURCHASED
+			if tm.ownerSession(i) == locker.String() {
+				result[i] = STATE_PURCHASED_BY_CURRENT
+			}
 		} else if val == "" {
 			result[i] = STATE_OPEN
+
+			// Expired ads are held for their owner during the priority window
+			owner := tm.ownerSession(i)
+			if owner != "" && owner != locker.String() {
+				result[i] = STATE_LOCKED_BY_OTHER
+			}
 		} else {
 			result[i] = STATE_LOCKED_BY_OTHER
 		}
 	}
-	return result
+	return result, nil
 }
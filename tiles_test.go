@@ -0,0 +1,111 @@
+package main
+
+import "testing"
+import "time"
+import "github.com/satori/go.uuid"
+import "gopkg.in/redis.v4"
+
+// newTestTileManager uses the redis of key_manager_test.go, starting tiles
+// from a clean state.
+func newTestTileManager(t *testing.T, renewPriority time.Duration, maxLocks int, maxLockHold time.Duration, tiles ...int) *TileManager {
+	if err := client.Ping().Err(); err != nil {
+		t.Skip("redis is not available:", err)
+	}
+
+	tm := NewTileManager(1000, client, renewPriority, maxLocks, maxLockHold)
+	for _, tile := range tiles {
+		client.Del(tm.keyForTile(tile), tm.keyForQuote(tile), tm.keyForOwner(tile), tm.KeyForBody(tile))
+	}
+	return tm
+}
+
+func TestLockLimit(t *testing.T) {
+	tm := newTestTileManager(t, 0, 2, 0, 970, 971, 972)
+	session := uuid.NewV4()
+
+	for _, tile := range []int{970, 971} {
+		if err, state := tm.Lock(tile, time.Minute, session, nil); err != nil || state != STATE_LOCKED_BY_CURRENT_USER {
+			t.Fatalf("unable to lock tile %d: %v %s", tile, err, state)
+		}
+	}
+	if err, _ := tm.Lock(972, time.Minute, session, nil); err != ErrLockLimit {
+		t.Errorf("got %v locking a third tile, want the lock limit", err)
+	}
+	if err, state := tm.Lock(970, time.Minute, session, nil); err != nil || state != STATE_LOCKED_BY_CURRENT_USER {
+		t.Errorf("held lock counted against the limit: %v %s", err, state)
+	}
+	if err, state := tm.Lock(972, time.Minute, uuid.NewV4(), nil); err != nil || state != STATE_LOCKED_BY_CURRENT_USER {
+		t.Errorf("limit applied to another session: %v %s", err, state)
+	}
+}
+
+func TestHeartbeatHoldLimit(t *testing.T) {
+	tm := newTestTileManager(t, 0, 0, time.Minute, 973)
+	session := uuid.NewV4()
+
+	if err, state := tm.Lock(973, 10*time.Second, session, nil); err != nil || state != STATE_LOCKED_BY_CURRENT_USER {
+		t.Fatalf("unable to lock tile: %v %s", err, state)
+	}
+	ttl, err := tm.Heartbeat(973, time.Hour, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl <= 10*time.Second || ttl > time.Minute {
+		t.Errorf("got %s left, want the lock extended up to the hold limit", ttl)
+	}
+
+	// Taken longer ago than the hold limit, the lock is left to expire
+	client.ZAdd(tm.keyForSessionLocks(session), redis.Z{
+		Score:  float64(time.Now().Add(-2*time.Minute).UnixNano() / int64(time.Millisecond)),
+		Member: "973",
+	})
+	again, err := tm.Heartbeat(973, time.Hour, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again > ttl {
+		t.Errorf("lock extended to %s past the hold limit", again)
+	}
+
+	if _, err := tm.Heartbeat(973, time.Hour, uuid.NewV4()); err == nil {
+		t.Error("heartbeat accepted from another session")
+	}
+}
+
+func TestRenewTile(t *testing.T) {
+	tm := newTestTileManager(t, time.Minute, 0, 0, 975)
+	owner := uuid.NewV4()
+
+	if err := tm.PurchaseTile(975, "hello", 10*time.Second, owner, "purchase"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.RenewTile(975, 10*time.Second, uuid.NewV4()); err == nil {
+		t.Error("tile renewed by somebody else")
+	}
+
+	// A running ad is extended by the renewal
+	ttl, err := tm.RenewTile(975, 10*time.Second, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl <= 10*time.Second || ttl > 20*time.Second {
+		t.Errorf("got %s left, want the running ad extended", ttl)
+	}
+
+	// Once the ad is over, the owner can still revive it during the
+	// priority window while nobody else can lock it
+	client.Del(tm.keyForTile(975))
+	if err, state := tm.Lock(975, time.Minute, uuid.NewV4(), nil); err != nil || state != STATE_LOCKED_BY_OTHER {
+		t.Errorf("tile locked during the priority window: %v %s", err, state)
+	}
+	ttl, err = tm.RenewTile(975, 10*time.Second, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl <= 0 || ttl > 10*time.Second {
+		t.Errorf("got %s left, want a fresh ad duration", ttl)
+	}
+	if val, _ := client.Get(tm.keyForTile(975)).Result(); val != "PURCHASED" {
+		t.Errorf("revived tile is %q", val)
+	}
+}